@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	auditCapacity   = 100000
+	auditMaxSamples = 10
+)
+
+// auditor remembers the last auditCapacity IDs issued by a node to find
+// duplicates and IDs that didn't sort after the previous one of their format.
+// Last holds the highest ID of every format among the calls that finished.
+type auditor struct {
+	recent []auditRecord
+	head   int
+	seen   map[string]int
+	last   map[string]any
+
+	issued     int
+	duplicates int
+	violations int
+	samples    []string
+
+	mu sync.Mutex
+}
+
+type auditRecord struct {
+	key string
+	at  time.Time
+}
+
+func newAuditor() *auditor {
+	return &auditor{
+		recent: make([]auditRecord, 0, auditCapacity),
+		seen:   make(map[string]int),
+		last:   make(map[string]any),
+	}
+}
+
+// track runs generate and records the IDs it returned. Generation isn't
+// serialized, so concurrent calls can finish in any order: an ID is only out
+// of order if it doesn't sort after the IDs of its own call before it and
+// the IDs of the calls that finished before its call started.
+func (a *auditor) track(format string, generate func() ([]any, error)) ([]any, error) {
+	a.mu.Lock()
+	floor := a.last[format]
+	a.mu.Unlock()
+
+	ids, err := generate()
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	prev := floor
+	for _, id := range ids {
+		a.record(format, id, prev, now)
+
+		if isMonotonic(format) {
+			prev = id
+		}
+	}
+
+	return ids, nil
+}
+
+// record counts an ID and checks it against prev, which is nil if there's
+// nothing it must sort after.
+// The caller must hold a.mu.
+func (a *auditor) record(format string, id, prev any, at time.Time) {
+	key := auditKey(format, id)
+
+	a.issued++
+
+	if a.seen[key] > 0 {
+		a.duplicates++
+		a.sample("duplicate %s", key)
+	}
+
+	if prev != nil && !issuedAfter(id, prev) {
+		a.violations++
+		a.sample("%s issued after %v", key, prev)
+	}
+
+	if last, ok := a.last[format]; isMonotonic(format) && (!ok || issuedAfter(id, last)) {
+		a.last[format] = id
+	}
+
+	if len(a.recent) < auditCapacity {
+		a.recent = append(a.recent, auditRecord{key: key, at: at})
+	} else {
+		evicted := a.recent[a.head]
+		if a.seen[evicted.key]--; a.seen[evicted.key] == 0 {
+			delete(a.seen, evicted.key)
+		}
+
+		a.recent[a.head] = auditRecord{key: key, at: at}
+		a.head = (a.head + 1) % auditCapacity
+	}
+
+	a.seen[key]++
+}
+
+func (a *auditor) sample(format string, args ...any) {
+	if len(a.samples) < auditMaxSamples {
+		a.samples = append(a.samples, fmt.Sprintf(format, args...))
+	}
+}
+
+type auditReport struct {
+	Issued                 int      `json:"issued"`
+	Tracked                int      `json:"tracked"`
+	Duplicates             int      `json:"duplicates"`
+	MonotonicityViolations int      `json:"monotonicity_violations"`
+	RatePerSec             float64  `json:"rate_per_sec"`
+	Samples                []string `json:"samples,omitempty"`
+	IDs                    []string `json:"ids,omitempty"`
+}
+
+// report summarizes the audit, the rate is measured over the tracked IDs.
+func (a *auditor) report(includeIDs bool) auditReport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	r := auditReport{
+		Issued:                 a.issued,
+		Tracked:                len(a.recent),
+		Duplicates:             a.duplicates,
+		MonotonicityViolations: a.violations,
+		Samples:                append([]string(nil), a.samples...),
+	}
+
+	if len(a.recent) > 1 {
+		oldest := a.recent[a.head]
+		newest := a.recent[(a.head+len(a.recent)-1)%len(a.recent)]
+
+		if elapsed := newest.at.Sub(oldest.at).Seconds(); elapsed > 0 {
+			r.RatePerSec = float64(len(a.recent)-1) / elapsed
+		}
+	}
+
+	if includeIDs {
+		r.IDs = make([]string, 0, len(a.seen))
+		for key := range a.seen {
+			r.IDs = append(r.IDs, key)
+		}
+	}
+
+	return r
+}
+
+// crossNodeDuplicates counts the IDs reported by more than one node.
+func crossNodeDuplicates(reports map[string]auditReport) int {
+	owners := make(map[string]int)
+	for _, r := range reports {
+		for _, key := range r.IDs {
+			owners[key]++
+		}
+	}
+
+	duplicates := 0
+	for _, count := range owners {
+		if count > 1 {
+			duplicates++
+		}
+	}
+
+	return duplicates
+}
+
+func auditKey(format string, id any) string {
+	if format == "" {
+		format = formatTimestamp
+	}
+
+	return fmt.Sprintf("%s:%v", format, id)
+}
+
+// isMonotonic tells whether a format promises increasing IDs on a node, the
+// timestamp one doesn't since two IDs can share the same nanosecond.
+func isMonotonic(format string) bool {
+	switch format {
+	case formatSnowflake, formatLeased, formatUUIDv7, formatULID:
+		return true
+	default:
+		return false
+	}
+}
+
+func issuedAfter(id, prev any) bool {
+	switch id := id.(type) {
+	case int64:
+		return id > prev.(int64)
+	case int:
+		return id > prev.(int)
+	case string:
+		return id > prev.(string)
+	default:
+		return true
+	}
+}
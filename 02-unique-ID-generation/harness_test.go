@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/RaffysWeb/gossip-glomers/02-unique-ID-generation/idgen"
+)
+
+// harnessFormats leaves out leased IDs since they need a lin-kv service.
+var harnessFormats = []string{formatTimestamp, formatSnowflake, formatUUIDv7, formatULID}
+
+// TestUniqueIDsUnderConcurrency spreads concurrent generate calls over
+// simulated nodes, each with its own auditor, and fails if any node issued a
+// duplicate or a non monotonic ID, or if two nodes issued the same ID.
+func TestUniqueIDsUnderConcurrency(t *testing.T) {
+	const (
+		nodes = 5
+		calls = 10000
+	)
+
+	servers := make(map[string]*server, nodes)
+
+	for i := 0; i < nodes; i++ {
+		sf, err := newSnowflake(int64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		servers[fmt.Sprintf("n%d", i)] = &server{
+			snowflake: sf,
+			idgen:     idgen.NewGenerator(),
+			auditor:   newAuditor(),
+		}
+	}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, calls)
+
+	call := 0
+	for call < calls {
+		for _, s := range servers {
+			if call == calls {
+				break
+			}
+
+			wg.Add(1)
+			go func(s *server, format string) {
+				defer wg.Done()
+				if _, err := s.generate(format, 1); err != nil {
+					errCh <- err
+				}
+			}(s, harnessFormats[call%len(harnessFormats)])
+
+			call++
+		}
+	}
+
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		t.Fatal(err)
+	}
+
+	reports := make(map[string]auditReport, len(servers))
+
+	for id, s := range servers {
+		r := s.auditor.report(true)
+		if r.Duplicates > 0 || r.MonotonicityViolations > 0 {
+			t.Errorf("node %s issued %d duplicates and %d out of order IDs: %v",
+				id, r.Duplicates, r.MonotonicityViolations, r.Samples)
+		}
+
+		reports[id] = r
+	}
+
+	if duplicates := crossNodeDuplicates(reports); duplicates > 0 {
+		t.Errorf("%d IDs were issued by more than one node", duplicates)
+	}
+}
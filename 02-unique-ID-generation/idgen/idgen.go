@@ -0,0 +1,161 @@
+// Package idgen generates time ordered 128-bit IDs encoded as RFC 9562
+// UUIDv7 or ULID strings.
+//
+// IDs from the same Generator are strictly increasing: within a millisecond
+// the random part is incremented instead of being drawn again, and if it
+// overflows the Generator moves on to the next millisecond.
+package idgen
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	// UUIDv7 keeps 74 random bits, the other 6 hold the version and variant.
+	uuidRandomBits = 74
+	ulidRandomBits = 80
+
+	crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+// Generator issues UUIDv7 and ULID strings, each format is monotonic on its
+// own. It is safe for concurrent use.
+type Generator struct {
+	uuid *monotonic
+	ulid *monotonic
+}
+
+func NewGenerator() *Generator {
+	return &Generator{
+		uuid: newMonotonic(uuidRandomBits),
+		ulid: newMonotonic(ulidRandomBits),
+	}
+}
+
+// UUIDv7 returns a new UUID like "01890a5d-ac96-774b-bcce-b302099a8057".
+func (g *Generator) UUIDv7() string {
+	ms, hi, lo := g.uuid.next()
+
+	randA := uint16(hi)<<2 | uint16(lo>>62)
+	randB := lo & (1<<62 - 1)
+
+	var b [16]byte
+	putMillis(b[:6], ms)
+	binary.BigEndian.PutUint16(b[6:8], 0x7000|randA)
+	binary.BigEndian.PutUint64(b[8:], 1<<63|randB)
+
+	buf := make([]byte, 36)
+	hex.Encode(buf[0:8], b[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], b[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], b[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], b[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], b[10:])
+
+	return string(buf)
+}
+
+// ULID returns a new ULID like "01H4G5VB4PEX5VSKNK0G4SN01Q".
+func (g *Generator) ULID() string {
+	ms, hi, lo := g.ulid.next()
+
+	// 26 characters of 5 bits cover the 128 bits plus 2 leading zero bits.
+	high := uint64(ms)<<16 | uint64(hi)
+
+	buf := make([]byte, 26)
+	for i := range buf {
+		buf[i] = crockford[fiveBits(high, lo, uint(5*(len(buf)-1-i)))]
+	}
+
+	return string(buf)
+}
+
+// fiveBits returns the 5 bits starting at shift of the 128-bit number high:low.
+func fiveBits(high, low uint64, shift uint) byte {
+	var v uint64
+
+	switch {
+	case shift >= 64:
+		v = high >> (shift - 64)
+	case shift > 59:
+		v = low>>shift | high<<(64-shift)
+	default:
+		v = low >> shift
+	}
+
+	return byte(v & 31)
+}
+
+func putMillis(b []byte, ms int64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(ms))
+	copy(b, buf[2:])
+}
+
+// monotonic keeps the last millisecond and random value handed out, the
+// random value is stored as hi:lo with hi holding the bits above 64.
+type monotonic struct {
+	hiMask uint16
+
+	lastMs int64
+	hi     uint16
+	lo     uint64
+
+	mu sync.Mutex
+}
+
+func newMonotonic(bits uint) *monotonic {
+	return &monotonic{hiMask: uint16(1<<(bits-64) - 1)}
+}
+
+func (m *monotonic) next() (int64, uint16, uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+
+	switch {
+	case now > m.lastMs:
+		m.lastMs = now
+		m.randomize()
+	case !m.increment():
+		m.lastMs++
+		m.randomize()
+	}
+
+	return m.lastMs, m.hi, m.lo
+}
+
+// increment adds one to the random value, it returns false on overflow.
+func (m *monotonic) increment() bool {
+	m.lo++
+	if m.lo != 0 {
+		return true
+	}
+
+	if m.hi == m.hiMask {
+		return false
+	}
+
+	m.hi++
+
+	return true
+}
+
+func (m *monotonic) randomize() {
+	var b [10]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// There's no sensible way to keep issuing IDs without entropy.
+		panic(err)
+	}
+
+	m.hi = binary.BigEndian.Uint16(b[:2]) & m.hiMask
+	m.lo = binary.BigEndian.Uint64(b[2:])
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+const (
+	leaseKey       = "id-lease"
+	leaseBlockSize = 1000
+)
+
+// leaser hands out integer IDs from blocks reserved in a lin-kv counter, so
+// a node only talks to the kv store once every leaseBlockSize IDs.
+type leaser struct {
+	kv *maelstrom.KV
+
+	next int
+	end  int
+
+	mu sync.Mutex
+}
+
+func newLeaser(kv *maelstrom.KV) *leaser {
+	return &leaser{kv: kv}
+}
+
+// take returns the next count IDs, reserving new blocks as needed.
+// IDs from a block that can't be handed out because of an error are skipped,
+// so leased IDs are unique but not contiguous.
+func (l *leaser) take(ctx context.Context, count int) ([]int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ids := make([]int, 0, count)
+
+	for len(ids) < count {
+		if l.next == l.end {
+			if err := l.reserve(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		ids = append(ids, l.next)
+		l.next++
+	}
+
+	return ids, nil
+}
+
+// reserve moves the shared counter forward by a block and keeps the range
+// for this node, retrying when another node moved it first.
+func (l *leaser) reserve(ctx context.Context) error {
+	for {
+		start, err := l.kv.ReadInt(ctx, leaseKey)
+		if err != nil && maelstrom.ErrorCode(err) != maelstrom.KeyDoesNotExist {
+			return err
+		}
+
+		end := start + leaseBlockSize
+
+		err = l.kv.CompareAndSwap(ctx, leaseKey, start, end, true)
+		if err == nil {
+			l.next, l.end = start, end
+			return nil
+		}
+
+		if maelstrom.ErrorCode(err) != maelstrom.PreconditionFailed {
+			return err
+		}
+	}
+}
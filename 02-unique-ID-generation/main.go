@@ -1,16 +1,203 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
+	"os"
 	"time"
 
+	"github.com/RaffysWeb/gossip-glomers/02-unique-ID-generation/idgen"
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
 )
 
+const (
+	timeout      = time.Second
+	maxBatchSize = 10000
+)
+
+const (
+	formatTimestamp = "timestamp.base64"
+	formatSnowflake = "snowflake"
+	formatLeased    = "leased"
+	formatUUIDv7    = "uuidv7"
+	formatULID      = "ulid"
+)
+
+type server struct {
+	n         *maelstrom.Node
+	snowflake *snowflake
+	leaser    *leaser
+	idgen     *idgen.Generator
+
+	// auditor is only set when the node runs with ID_AUDIT=1.
+	auditor *auditor
+}
+
+func main() {
+	n := maelstrom.NewNode()
+	s := &server{
+		n:      n,
+		leaser: newLeaser(maelstrom.NewLinKV(n)),
+		idgen:  idgen.NewGenerator(),
+	}
+
+	if os.Getenv("ID_AUDIT") == "1" {
+		s.auditor = newAuditor()
+	}
+
+	n.Handle("init", s.initHandler)
+	n.Handle("generate", s.generateHandler)
+	n.Handle("generate_batch", s.generateBatchHandler)
+	n.Handle("audit", s.auditHandler)
+
+	if err := n.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (s *server) initHandler(msg maelstrom.Message) error {
+	// A node whose ordinal doesn't fit in the snowflake node bits still
+	// serves the other formats, it only refuses snowflake IDs.
+	ordinal, err := nodeOrdinal(s.n.ID(), s.n.NodeIDs())
+	if err != nil {
+		log.Printf("snowflake IDs disabled: %v", err)
+		return nil
+	}
+
+	sf, err := newSnowflake(ordinal)
+	if err != nil {
+		log.Printf("snowflake IDs disabled: %v", err)
+		return nil
+	}
+
+	s.snowflake = sf
+
+	return nil
+}
+
+type generateReq struct {
+	IDFormat string `json:"id_format,omitempty"`
+	Count    int    `json:"count,omitempty"`
+}
+
+func (s *server) generateHandler(msg maelstrom.Message) error {
+	var body map[string]any
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	var req generateReq
+	if err := json.Unmarshal(msg.Body, &req); err != nil {
+		return err
+	}
+
+	ids, err := s.generate(req.IDFormat, 1)
+	if err != nil {
+		return err
+	}
+
+	body["type"] = "generate_ok"
+	body["id"] = ids[0]
+
+	return s.reply(msg, body)
+}
+
+func (s *server) generateBatchHandler(msg maelstrom.Message) error {
+	var body generateReq
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	if body.Count < 1 || body.Count > maxBatchSize {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest,
+			fmt.Sprintf("count must be between 1 and %d", maxBatchSize))
+	}
+
+	ids, err := s.generate(body.IDFormat, body.Count)
+	if err != nil {
+		return err
+	}
+
+	return s.reply(msg, map[string]any{
+		"type": "generate_batch_ok",
+		"ids":  ids,
+	})
+}
+
+// reply works like n.Reply but keeps 64 bit IDs intact, n.Reply round trips
+// the body through a map[string]any which turns every number into a float64.
+func (s *server) reply(req maelstrom.Message, body map[string]any) error {
+	var reqBody maelstrom.MessageBody
+	if err := json.Unmarshal(req.Body, &reqBody); err != nil {
+		return err
+	}
+
+	body["in_reply_to"] = reqBody.MsgID
+
+	return s.n.Send(req.Src, body)
+}
+
+// generate returns count new IDs in the requested format, defaulting to the
+// timestamp and random string one.
+func (s *server) generate(format string, count int) ([]any, error) {
+	if s.auditor == nil {
+		return s.newIDs(format, count)
+	}
+
+	return s.auditor.track(format, func() ([]any, error) {
+		return s.newIDs(format, count)
+	})
+}
+
+func (s *server) newIDs(format string, count int) ([]any, error) {
+	ids := make([]any, 0, count)
+
+	switch format {
+	case "", formatTimestamp:
+		for i := 0; i < count; i++ {
+			ids = append(ids, generateUniqueId())
+		}
+	case formatSnowflake:
+		if s.snowflake == nil {
+			return nil, maelstrom.NewRPCError(maelstrom.NotSupported,
+				fmt.Sprintf("node %s has no snowflake node ordinal", s.n.ID()))
+		}
+
+		for i := 0; i < count; i++ {
+			ids = append(ids, s.snowflake.next())
+		}
+	case formatUUIDv7:
+		for i := 0; i < count; i++ {
+			ids = append(ids, s.idgen.UUIDv7())
+		}
+	case formatULID:
+		for i := 0; i < count; i++ {
+			ids = append(ids, s.idgen.ULID())
+		}
+	case formatLeased:
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		leased, err := s.leaser.take(ctx, count)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, id := range leased {
+			ids = append(ids, id)
+		}
+	default:
+		return nil, maelstrom.NewRPCError(maelstrom.MalformedRequest,
+			fmt.Sprintf("unknown id_format %q", format))
+	}
+
+	return ids, nil
+}
+
 func generateUniqueId() string {
 	randomBytes := make([]byte, 16)
 	_, err := rand.Read(randomBytes)
@@ -24,22 +211,77 @@ func generateUniqueId() string {
 	return fmt.Sprintf("%d.%s", timestamp, randomString)
 }
 
-func main() {
-	n := maelstrom.NewNode()
+type auditReq struct {
+	Cluster    bool `json:"cluster,omitempty"`
+	IncludeIDs bool `json:"include_ids,omitempty"`
+}
+
+// auditHandler reports the audit of this node, or of every node when
+// cluster is set, in which case IDs issued by more than one node are also
+// counted.
+func (s *server) auditHandler(msg maelstrom.Message) error {
+	var body auditReq
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	if s.auditor == nil {
+		return maelstrom.NewRPCError(maelstrom.NotSupported, "audit is disabled, start the node with ID_AUDIT=1")
+	}
+
+	if !body.Cluster {
+		return s.n.Reply(msg, map[string]any{
+			"type":  "audit_ok",
+			"nodes": map[string]auditReport{s.n.ID(): s.auditor.report(body.IncludeIDs)},
+		})
+	}
+
+	reports := map[string]auditReport{s.n.ID(): s.auditor.report(true)}
+	unreachable := []string{}
+
+	for _, nodeID := range s.n.NodeIDs() {
+		if nodeID == s.n.ID() {
+			continue
+		}
 
-	n.Handle("generate", func(msg maelstrom.Message) error {
-		var body map[string]any
-		if err := json.Unmarshal(msg.Body, &body); err != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		res, err := s.n.SyncRPC(ctx, nodeID, map[string]any{
+			"type":        "audit",
+			"include_ids": true,
+		})
+		cancel()
+
+		if err != nil {
+			log.Printf("audit %s: %v", nodeID, err)
+			unreachable = append(unreachable, nodeID)
+			continue
+		}
+
+		var peer struct {
+			Nodes map[string]auditReport `json:"nodes"`
+		}
+		if err := json.Unmarshal(res.Body, &peer); err != nil {
 			return err
 		}
 
-		body["type"] = "generate_ok"
-		body["id"] = generateUniqueId()
+		for id, r := range peer.Nodes {
+			reports[id] = r
+		}
+	}
 
-		return n.Reply(msg, body)
-	})
+	duplicates := crossNodeDuplicates(reports)
 
-	if err := n.Run(); err != nil {
-		log.Fatal(err)
+	if !body.IncludeIDs {
+		for id, r := range reports {
+			r.IDs = nil
+			reports[id] = r
+		}
 	}
+
+	return s.n.Reply(msg, map[string]any{
+		"type":                  "audit_ok",
+		"nodes":                 reports,
+		"cross_node_duplicates": duplicates,
+		"unreachable":           unreachable,
+	})
 }
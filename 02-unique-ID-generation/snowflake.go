@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snowflake IDs are 63 bit integers laid out as
+//
+//	| 41 bits milliseconds since epoch | 10 bits node | 12 bits sequence |
+//
+// so they sort by creation time and fit in a signed bigint column.
+const (
+	snowflakeNodeBits     = 10
+	snowflakeSequenceBits = 12
+
+	snowflakeMaxNode     = 1<<snowflakeNodeBits - 1
+	snowflakeMaxSequence = 1<<snowflakeSequenceBits - 1
+)
+
+// snowflakeEpoch keeps the timestamps small enough to last ~69 years in 41 bits.
+var snowflakeEpoch = time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+type snowflake struct {
+	node int64
+
+	lastMs   int64
+	sequence int64
+
+	mu sync.Mutex
+}
+
+func newSnowflake(node int64) (*snowflake, error) {
+	if node < 0 || node > snowflakeMaxNode {
+		return nil, fmt.Errorf("snowflake node %d out of range [0, %d]", node, snowflakeMaxNode)
+	}
+
+	return &snowflake{node: node}, nil
+}
+
+// next returns the next ID for the node.
+// If the clock moves backwards we keep issuing IDs from the last timestamp
+// we used, and once its sequence is exhausted we move to the following
+// millisecond instead of waiting for the clock to catch up.
+func (s *snowflake) next() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Since(snowflakeEpoch).Milliseconds()
+
+	switch {
+	case now > s.lastMs:
+		s.lastMs = now
+		s.sequence = 0
+	case s.sequence < snowflakeMaxSequence:
+		s.sequence++
+	default:
+		s.lastMs++
+		s.sequence = 0
+	}
+
+	return s.lastMs<<(snowflakeNodeBits+snowflakeSequenceBits) |
+		s.node<<snowflakeSequenceBits |
+		s.sequence
+}
+
+// nodeOrdinal turns a maelstrom node ID like "n3" into 3, nodes with a
+// different naming scheme use their position in the sorted cluster. It fails
+// if the ordinal doesn't fit in the node bits instead of letting it spill
+// into the timestamp.
+func nodeOrdinal(nodeID string, nodeIDs []string) (int64, error) {
+	var ordinal int64
+
+	if digits := strings.TrimPrefix(nodeID, "n"); digits != nodeID && isDigits(digits) {
+		parsed, err := strconv.ParseInt(digits, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("node %s: %w", nodeID, err)
+		}
+
+		ordinal = parsed
+	} else {
+		sorted := append([]string(nil), nodeIDs...)
+		sort.Strings(sorted)
+
+		ordinal = int64(sort.SearchStrings(sorted, nodeID))
+	}
+
+	if ordinal > snowflakeMaxNode {
+		return 0, fmt.Errorf("node %s has ordinal %d, snowflake IDs only fit %d nodes",
+			nodeID, ordinal, snowflakeMaxNode+1)
+	}
+
+	return ordinal, nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"sync"
 	"time"
@@ -17,7 +18,8 @@ type server struct {
 	kv    *maelstrom.KV
 	store map[string]int
 
-	mu sync.RWMutex
+	mu      sync.RWMutex
+	storeMu sync.RWMutex
 }
 
 func main() {
@@ -72,6 +74,7 @@ func (s *server) addHandler(msg maelstrom.Message) error {
 
 	sum, err := s.kv.ReadInt(ctx, s.n.ID())
 	if err != nil {
+		s.mu.Unlock()
 		return err
 	}
 
@@ -82,96 +85,159 @@ func (s *server) addHandler(msg maelstrom.Message) error {
 		return err
 	}
 
+	s.cacheValue(s.n.ID(), sum+body.Delta)
+
 	return s.n.Reply(msg, map[string]any{
 		"type": "add_ok",
 	})
 }
 
+const (
+	readLocal  = "local"
+	readQuorum = "quorum"
+	readFresh  = "fresh"
+)
+
 type readReq struct {
-	Value int `json:"value"`
+	Value       int    `json:"value"`
+	Consistency string `json:"consistency,omitempty"`
 }
 
+// readHandler sums the counter according to the requested consistency:
+//   - local: the cached values only, without contacting any node
+//   - quorum: waits for a majority of nodes, the rest come from the cache
+//   - fresh: waits for every node and fails if any of them is unreachable
+//
+// Without a consistency field it asks every node and falls back to the
+// cache for the ones that don't answer.
 func (s *server) readHandler(msg maelstrom.Message) error {
 	var body readReq
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
 		return err
 	}
 
-	total := 0
-	resultCh := make(chan int, len(s.n.NodeIDs()))
-	errorCh := make(chan error, len(s.n.NodeIDs()))
-	var wg sync.WaitGroup
+	var (
+		total int
+		err   error
+	)
+
+	switch body.Consistency {
+	case readLocal:
+		total = s.cachedSum()
+	case readQuorum:
+		total, err = s.readSum(len(s.n.NodeIDs())/2 + 1)
+	case readFresh:
+		total, err = s.readSum(len(s.n.NodeIDs()))
+	case "":
+		total, err = s.readSum(0)
+	default:
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest,
+			fmt.Sprintf("unknown consistency %q", body.Consistency))
+	}
 
-	for _, nID := range s.n.NodeIDs() {
-		wg.Add(1)
+	if err != nil {
+		return err
+	}
+
+	res := map[string]any{
+		"type":  "read_ok",
+		"value": total,
+	}
+
+	return s.n.Reply(msg, res)
+}
+
+type nodeValue struct {
+	nodeID string
+	value  int
+	err    error
+}
+
+// readSum asks every node for its value and returns the sum once `required`
+// of them answered, using the cache for the others. A required of 0 waits
+// for all the nodes but never fails.
+func (s *server) readSum(required int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	nodeIDs := s.n.NodeIDs()
+	resultCh := make(chan nodeValue, len(nodeIDs))
+
+	for _, nID := range nodeIDs {
 		go func(nodeID string) {
-			defer wg.Done()
-			if nodeID == s.n.ID() {
-				ctx, cancel := context.WithTimeout(context.Background(), timeout)
-				defer cancel()
-
-				v, err := s.kv.ReadInt(ctx, s.n.ID())
-				if err != nil {
-					errorCh <- err
-					v = s.store[nodeID]
-				}
-
-				s.store[nodeID] = v
-				resultCh <- v
-				return
-			}
+			v, err := s.fetchValue(ctx, nodeID)
+			resultCh <- nodeValue{nodeID: nodeID, value: v, err: err}
+		}(nID)
+	}
 
-			ctx, cancel := context.WithTimeout(context.Background(), timeout)
-			defer cancel()
-
-			// If it's not the local node, try to fetch from the remote node
-			res, err := s.n.SyncRPC(ctx, nodeID, map[string]any{
-				"type": "getSum",
-			})
-			// If it fails, get from the local store
-			if err != nil {
-				errorCh <- err
-				v, exists := s.store[nodeID]
-				if !exists {
-					s.store[nodeID] = 0
-					resultCh <- 0
-					return
-				}
-
-				resultCh <- v
-				return
-			}
+	ok, failed := 0, 0
+	for range nodeIDs {
+		res := <-resultCh
+		if res.err != nil {
+			log.Printf("error: %v", res.err)
 
-			if err := json.Unmarshal(res.Body, &body); err != nil {
-				errorCh <- err
-				resultCh <- 0
-				return
+			failed++
+			if len(nodeIDs)-failed < required {
+				return 0, maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable,
+					fmt.Sprintf("%d of %d nodes unreachable, %d required", failed, len(nodeIDs), required))
 			}
+			continue
+		}
 
-			// Save in local cache
-			s.store[nodeID] = body.Value
-			resultCh <- body.Value
-		}(nID)
+		s.cacheValue(res.nodeID, res.value)
+
+		ok++
+		if required > 0 && ok >= required {
+			break
+		}
 	}
 
-	wg.Wait()
-	close(resultCh)
-	close(errorCh)
+	return s.cachedSum(), nil
+}
 
-	for v := range resultCh {
-		total += v
+// fetchValue reads the value of the local node from the kv store and asks
+// remote nodes for theirs.
+func (s *server) fetchValue(ctx context.Context, nodeID string) (int, error) {
+	if nodeID == s.n.ID() {
+		return s.kv.ReadInt(ctx, nodeID)
 	}
 
-	for err := range errorCh {
-		log.Printf("error: %v", err)
+	res, err := s.n.SyncRPC(ctx, nodeID, map[string]any{
+		"type": "getSum",
+	})
+	if err != nil {
+		return 0, err
 	}
 
-	res := map[string]any{
-		"type":  "read_ok",
-		"value": total,
+	var body readReq
+	if err := json.Unmarshal(res.Body, &body); err != nil {
+		return 0, err
 	}
 
-	return s.n.Reply(msg, res)
+	return body.Value, nil
+}
+
+// cacheValue keeps the highest value seen for a node, values only grow so
+// a stale read never moves the cache backwards.
+func (s *server) cacheValue(nodeID string, v int) {
+	s.storeMu.Lock()
+	defer s.storeMu.Unlock()
+
+	if v > s.store[nodeID] {
+		s.store[nodeID] = v
+	}
+}
+
+func (s *server) cachedSum() int {
+	s.storeMu.RLock()
+	defer s.storeMu.RUnlock()
+
+	total := 0
+	for _, v := range s.store {
+		total += v
+	}
+
+	return total
 }
 
 func (s *server) getSumHandler(msg maelstrom.Message) error {
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// The admin RPCs go through the write-ahead log like any other change, as
+// truncations and commits, so they survive restarts. Truncating never resets
+// the offsets of a key, new messages keep numbering after the dropped ones.
+
+type truncateMsg struct {
+	Type   string `json:"type"`
+	Key    string `json:"key"`
+	Offset int    `json:"offset,omitempty"`
+}
+
+// deleteKeyHandler drops every message of a key.
+func (s *server) deleteKeyHandler(msg maelstrom.Message) error {
+	var body truncateMsg
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.logs[body.Key]; !exists {
+		return maelstrom.NewRPCError(maelstrom.KeyDoesNotExist,
+			fmt.Sprintf("key %s does not exist", body.Key))
+	}
+
+	start, err := s.truncate(body.Key, s.nextOffset(body.Key))
+	if err != nil {
+		return err
+	}
+
+	return s.n.Reply(msg, map[string]any{
+		"type":      "delete_key_ok",
+		"log_start": start,
+	})
+}
+
+// truncateBeforeHandler drops the messages of a key before an offset, the
+// offset can be at most the one the next message gets.
+func (s *server) truncateBeforeHandler(msg maelstrom.Message) error {
+	var body truncateMsg
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if next := s.nextOffset(body.Key); body.Offset > next {
+		return maelstrom.NewRPCError(maelstrom.PreconditionFailed,
+			fmt.Sprintf("offset %d of %s is past its end at %d", body.Offset, body.Key, next))
+	}
+
+	start, err := s.truncate(body.Key, body.Offset)
+	if err != nil {
+		return err
+	}
+
+	return s.n.Reply(msg, map[string]any{
+		"type":      "truncate_before_ok",
+		"log_start": start,
+	})
+}
+
+// truncate moves the start of a log forward to offset and returns the new
+// start, truncating before the current start is a no-op.
+// The caller must hold s.mu.
+func (s *server) truncate(key string, offset int) (int, error) {
+	if offset <= s.logStart[key] {
+		return s.logStart[key], nil
+	}
+
+	err := s.persist(walRecord{
+		Op:    opTruncate,
+		Key:   key,
+		Start: offset,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return offset, nil
+}
+
+const (
+	resetEarliest = "earliest"
+	resetLatest   = "latest"
+)
+
+type resetOffsetsMsg struct {
+	Type   string          `json:"type"`
+	Group  string          `json:"group,omitempty"`
+	Key    string          `json:"key"`
+	Offset json.RawMessage `json:"offset"`
+}
+
+// resetOffsetsHandler commits an offset for a group, unlike commit_offsets it
+// can move it backwards. The offset is a number, earliest to consume the key
+// again from the start of its log or latest to skip to its end. Committed
+// offsets are the last one consumed, so both commit the offset before.
+func (s *server) resetOffsetsHandler(msg maelstrom.Message) error {
+	var body resetOffsetsMsg
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	offset, err := s.resetOffset(body.Key, body.Offset)
+	if err != nil {
+		return err
+	}
+
+	err = s.persist(walRecord{
+		Op:      opCommit,
+		Group:   body.Group,
+		Offsets: map[string]int{body.Key: offset},
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.n.Reply(msg, map[string]any{
+		"type":   "reset_offsets_ok",
+		"offset": offset,
+	})
+}
+
+// resetOffset resolves the offset of a reset_offsets request.
+// The caller must hold s.mu.
+func (s *server) resetOffset(key string, raw json.RawMessage) (int, error) {
+	var offset int
+	if err := json.Unmarshal(raw, &offset); err == nil {
+		return offset, nil
+	}
+
+	var position string
+	if err := json.Unmarshal(raw, &position); err == nil {
+		switch position {
+		case resetEarliest:
+			return s.logStart[key] - 1, nil
+		case resetLatest:
+			return s.nextOffset(key) - 1, nil
+		}
+	}
+
+	return 0, maelstrom.NewRPCError(maelstrom.MalformedRequest,
+		fmt.Sprintf("invalid offset %s, expected a number, %q or %q", raw, resetEarliest, resetLatest))
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+// Optional features are configured with environment variables since
+// maelstrom starts the binary without arguments.
+
+func envInt(name string, def int) int {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", name, err)
+	}
+
+	return i
+}
+
+func envBool(name string) bool {
+	return os.Getenv(name) == "1" || os.Getenv(name) == "true"
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// indexInterval is how many entries of a log each index entry covers.
+const indexInterval = 32
+
+// indexEntry points at the first of the indexInterval entries it covers and
+// keeps the latest timestamp of the log up to the last of them, so the
+// timestamps in the index never go backwards even if the clock does.
+type indexEntry struct {
+	offset  int
+	pos     int
+	maxTime time.Time
+}
+
+// addToIndex adds the entry at pos in a log to its index.
+func addToIndex(index []indexEntry, entry logEntry, pos int) []indexEntry {
+	if pos%indexInterval == 0 {
+		maxTime := entry.time
+		if len(index) > 0 && index[len(index)-1].maxTime.After(maxTime) {
+			maxTime = index[len(index)-1].maxTime
+		}
+
+		return append(index, indexEntry{offset: entry.offset, pos: pos, maxTime: maxTime})
+	}
+
+	if last := &index[len(index)-1]; entry.time.After(last.maxTime) {
+		last.maxTime = entry.time
+	}
+
+	return index
+}
+
+// reindex rebuilds the index of a key after entries were dropped from it.
+// The caller must hold s.mu.
+func (s *server) reindex(key string) {
+	var index []indexEntry
+	for pos, entry := range s.logs[key] {
+		index = addToIndex(index, entry, pos)
+	}
+
+	s.indexes[key] = index
+}
+
+// position returns the position in the log of a key of the first entry at
+// or after offset.
+// The caller must hold s.mu.
+func (s *server) position(key string, offset int) int {
+	logs, index := s.logs[key], s.indexes[key]
+
+	pos := 0
+	if i := sort.Search(len(index), func(i int) bool { return index[i].offset > offset }) - 1; i >= 0 {
+		pos = index[i].pos
+	}
+
+	for pos < len(logs) && logs[pos].offset < offset {
+		pos++
+	}
+
+	return pos
+}
+
+// timePosition returns the position in the log of a key of the first entry
+// with a timestamp at or after t.
+// The caller must hold s.mu.
+func (s *server) timePosition(key string, t time.Time) int {
+	logs, index := s.logs[key], s.indexes[key]
+
+	i := sort.Search(len(index), func(i int) bool { return !index[i].maxTime.Before(t) })
+	if i == len(index) {
+		return len(logs)
+	}
+
+	pos := index[i].pos
+	for pos < len(logs) && logs[pos].time.Before(t) {
+		pos++
+	}
+
+	return pos
+}
+
+// offsetsForTimes returns the offset of the first entry of every key with a
+// timestamp at or after the given one in milliseconds, or the next offset of
+// the key if there is none yet.
+// The caller must hold s.mu.
+func (s *server) offsetsForTimes(timestamps map[string]int64) map[string]int {
+	offsets := make(map[string]int, len(timestamps))
+
+	for key, ts := range timestamps {
+		offsets[key] = s.nextOffset(key)
+		if pos := s.timePosition(key, time.UnixMilli(ts)); pos < len(s.logs[key]) {
+			offsets[key] = s.logs[key][pos].offset
+		}
+	}
+
+	return offsets
+}
+
+type timestampsMsg struct {
+	Type       string           `json:"type"`
+	Timestamps map[string]int64 `json:"timestamps"`
+	Metadata   bool             `json:"metadata,omitempty"`
+	pollLimits
+}
+
+func (s *server) offsetsForTimesHandler(msg maelstrom.Message) error {
+	var body timestampsMsg
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.n.Reply(msg, map[string]any{
+		"type":    "offsets_for_times_ok",
+		"offsets": s.offsetsForTimes(body.Timestamps),
+	})
+}
+
+// pollByTimeHandler polls every key from its first entry at or after the
+// given timestamp.
+func (s *server) pollByTimeHandler(msg maelstrom.Message) error {
+	var body timestampsMsg
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	offsets := s.offsetsForTimes(body.Timestamps)
+	msgs, err := s.readMsgs(offsets, body.Metadata)
+	s.mu.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	msgs, nextOffsets, err := limitMsgs(msgs, offsets, body.pollLimits)
+	if err != nil {
+		return err
+	}
+
+	return s.n.Reply(msg, map[string]any{
+		"type":         "poll_by_time_ok",
+		"msgs":         msgs,
+		"next_offsets": nextOffsets,
+	})
+}
@@ -2,22 +2,53 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
+	"sort"
 	"sync"
+	"time"
 
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
 )
 
 type server struct {
-	n       *maelstrom.Node
-	logs    map[string][]logEntry
-	offsets map[string]int
-	mu      sync.RWMutex
+	n    *maelstrom.Node
+	logs map[string][]logEntry
+
+	// indexes holds a sparse offset and timestamp index of every log.
+	indexes map[string][]indexEntry
+
+	// offsets holds the committed offsets of every consumer group, the
+	// default group has an empty name.
+	offsets map[string]map[string]int
+
+	// topics holds the number of partitions of every topic.
+	topics map[string]int
+
+	// logStart holds the first offset of the logs retention or the admin RPCs
+	// truncated.
+	logStart  map[string]int
+	retention retentionPolicy
+
+	// waiters holds the polls parked on each key until a send to it.
+	waiters map[string][]chan struct{}
+
+	producers map[producerKey]*producerState
+
+	// appendRates counts the recent sends to every key.
+	appendRates map[string]*rateCounter
+
+	// wal is the write-ahead log every change goes through, nil if disabled.
+	wal *wal
+
+	mu sync.RWMutex
 }
 
 type logEntry struct {
-	offset int
-	msg    int
+	offset  int
+	msg     json.RawMessage
+	headers map[string]string
+	time    time.Time
 }
 
 func main() {
@@ -25,23 +56,57 @@ func main() {
 	s := &server{
 		n:       n,
 		logs:    make(map[string][]logEntry),
-		offsets: make(map[string]int),
+		indexes: make(map[string][]indexEntry),
+		offsets: make(map[string]map[string]int),
+		topics:  make(map[string]int),
+
+		logStart:  make(map[string]int),
+		retention: retentionFromEnv(),
+
+		waiters:   make(map[string][]chan struct{}),
+		producers: make(map[producerKey]*producerState),
+
+		appendRates: make(map[string]*rateCounter),
 	}
 
+	if err := s.openWAL(); err != nil {
+		log.Fatal(err)
+	}
+
+	s.newRetentionWorker()
+
+	n.Handle("create_topic", s.createTopicHandler)
 	n.Handle("send", s.sendHandler)
 	n.Handle("poll", s.pollHandler)
+	n.Handle("offsets_for_times", s.offsetsForTimesHandler)
+	n.Handle("poll_by_time", s.pollByTimeHandler)
 	n.Handle("commit_offsets", s.commitOffsetsHandler)
 	n.Handle("list_committed_offsets", s.listCommitedOffsetsHandler)
+	n.Handle("list_groups", s.listGroupsHandler)
+	n.Handle("delete_group", s.deleteGroupHandler)
+	n.Handle("admin_stats", s.adminStatsHandler)
+	n.Handle("delete_key", s.deleteKeyHandler)
+	n.Handle("truncate_before", s.truncateBeforeHandler)
+	n.Handle("reset_offsets", s.resetOffsetsHandler)
 
 	if err := n.Run(); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// sendMsg optionally carries a producer ID and a sequence number that grows
+// with every send of the producer, a retried send with the same sequence
+// number gets the offset originally assigned instead of a new entry.
+// With a topic the key is the key of the message, which picks its partition.
 type sendMsg struct {
-	Type string `json:"type"`
-	Key  string `json:"key"`
-	Msg  int    `json:"msg"`
+	Type       string            `json:"type"`
+	Key        string            `json:"key"`
+	Msg        json.RawMessage   `json:"msg"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Timestamp  int64             `json:"timestamp,omitempty"`
+	Topic      string            `json:"topic,omitempty"`
+	ProducerID string            `json:"producer_id,omitempty"`
+	Seq        int               `json:"seq,omitempty"`
 }
 
 func (s *server) sendHandler(msg maelstrom.Message) error {
@@ -50,60 +115,179 @@ func (s *server) sendHandler(msg maelstrom.Message) error {
 		return err
 	}
 
+	if body.Topic == "" {
+		if err := checkKey(body.Key); err != nil {
+			return err
+		}
+	}
+
+	payload, err := compactMsg(body.Msg)
+	if err != nil {
+		return err
+	}
+
+	timestamp := body.Timestamp
+	if timestamp == 0 {
+		timestamp = time.Now().UnixMilli()
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	offset := 0
+	res := map[string]any{
+		"type": "send_ok",
+	}
+
+	if body.Topic != "" {
+		partitions, err := s.topicPartitions(body.Topic)
+		if err != nil {
+			return err
+		}
 
-	// get the last offset
-	if len(s.logs[body.Key]) > 0 {
-		offset = s.logs[body.Key][len(s.logs[body.Key])-1].offset + 1
+		partition := partitionFor(body.Key, partitions)
+		body.Key = partitionKey(body.Topic, partition)
+		res["partition"] = partition
 	}
 
-	s.logs[body.Key] = append(s.logs[body.Key], logEntry{
-		offset: offset,
-		msg:    body.Msg,
-	})
+	if body.ProducerID != "" {
+		pk := producerKey{producer: body.ProducerID, key: body.Key}
+		offset, found, err := s.producers[pk].lookup(body.ProducerID, body.Seq)
+		if err != nil {
+			return err
+		}
 
-	return s.n.Reply(msg, map[string]any{
-		"type":   "send_ok",
-		"offset": offset,
+		if found {
+			res["offset"] = offset
+			return s.n.Reply(msg, res)
+		}
+	}
+
+	offset := s.nextOffset(body.Key)
+
+	err = s.persist(walRecord{
+		Op:       opSend,
+		Key:      body.Key,
+		Offset:   offset,
+		Msg:      payload,
+		Headers:  body.Headers,
+		Time:     timestamp,
+		Producer: body.ProducerID,
+		Seq:      body.Seq,
 	})
+	if err != nil {
+		return err
+	}
+
+	if s.appendRates[body.Key] == nil {
+		s.appendRates[body.Key] = &rateCounter{}
+	}
+	s.appendRates[body.Key].add(time.Now())
+
+	res["offset"] = offset
+
+	return s.n.Reply(msg, res)
 }
 
+// nextOffset returns the offset the next send to a key gets.
+// The caller must hold s.mu.
+func (s *server) nextOffset(key string) int {
+	logs := s.logs[key]
+	if len(logs) > 0 {
+		return logs[len(logs)-1].offset + 1
+	}
+
+	// retention can drop every entry of a key, offsets continue after them
+	return s.logStart[key]
+}
+
+// offsetsMsg lists the topics a poll subscribes to next to the offsets of
+// its keys, with Metadata the poll also returns the headers and timestamp of
+// every message.
 type offsetsMsg struct {
-	Offsets map[string]int `json:"offsets"`
-	Type    string         `json:"type"`
+	Offsets  map[string]int `json:"offsets"`
+	Type     string         `json:"type"`
+	Group    string         `json:"group,omitempty"`
+	Topics   []string       `json:"topics,omitempty"`
+	WaitMs   int            `json:"wait_ms,omitempty"`
+	Metadata bool           `json:"metadata,omitempty"`
+	pollLimits
 }
 
+// pollHandler returns the messages from the requested offsets onwards.
+// With wait_ms it parks until a send to one of the keys adds a message or
+// the timeout elapses, whichever comes first.
 func (s *server) pollHandler(msg maelstrom.Message) error {
 	var body offsetsMsg
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
 		return err
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.mu.RLock()
+	offsets, err := s.subscribe(body.Offsets, body.Topics)
+	s.mu.RUnlock()
+
+	if err != nil {
+		return err
+	}
 
-	msgs := make(map[string][][]int)
+	wait := time.Duration(body.WaitMs) * time.Millisecond
+	if wait > maxPollWait {
+		wait = maxPollWait
+	}
+	deadline := time.Now().Add(wait)
 
-	for key, offset := range body.Offsets {
-		logs := s.logs[key]
-		index := getOffsetIndex(logs, offset)
+	for {
+		s.mu.Lock()
 
-		for ; index < len(logs); index++ {
-			entries := logs[index]
-			intEntry := []int{entries.offset, entries.msg}
-			msgs[key] = append(msgs[key], intEntry)
+		msgs, err := s.readMsgs(offsets, body.Metadata)
+		if err != nil {
+			s.mu.Unlock()
+			return err
 		}
+
+		remaining := time.Until(deadline)
+		if len(msgs) > 0 || remaining <= 0 {
+			s.mu.Unlock()
+
+			msgs, nextOffsets, err := limitMsgs(msgs, offsets, body.pollLimits)
+			if err != nil {
+				return err
+			}
+
+			res := map[string]any{
+				"type":         "poll_ok",
+				"msgs":         msgs,
+				"next_offsets": nextOffsets,
+			}
+
+			return s.n.Reply(msg, res)
+		}
+
+		w := s.addWaiter(offsets)
+		s.mu.Unlock()
+
+		s.wait(w, offsets, remaining)
 	}
+}
 
-	res := map[string]any{
-		"type": "poll_ok",
-		"msgs": msgs,
+// readMsgs returns the messages of every key from its offset onwards.
+// The caller must hold s.mu.
+func (s *server) readMsgs(offsets map[string]int, metadata bool) (map[string][]polledMsg, error) {
+	msgs := make(map[string][]polledMsg)
+
+	for key, offset := range offsets {
+		if err := s.checkTruncated(key, offset); err != nil {
+			return nil, err
+		}
+
+		logs := s.logs[key]
+
+		for index := s.position(key, offset); index < len(logs); index++ {
+			msgs[key] = append(msgs[key], logs[index].polled(metadata))
+		}
 	}
 
-	return s.n.Reply(msg, res)
+	return msgs, nil
 }
 
 func (s *server) commitOffsetsHandler(msg maelstrom.Message) error {
@@ -115,8 +299,13 @@ func (s *server) commitOffsetsHandler(msg maelstrom.Message) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	for k, v := range body.Offsets {
-		s.offsets[k] = v
+	err := s.persist(walRecord{
+		Op:      opCommit,
+		Group:   body.Group,
+		Offsets: body.Offsets,
+	})
+	if err != nil {
+		return err
 	}
 
 	res := map[string]any{
@@ -126,8 +315,13 @@ func (s *server) commitOffsetsHandler(msg maelstrom.Message) error {
 	return s.n.Reply(msg, res)
 }
 
+type groupMsg struct {
+	Type  string `json:"type"`
+	Group string `json:"group,omitempty"`
+}
+
 func (s *server) listCommitedOffsetsHandler(msg maelstrom.Message) error {
-	var body map[string]any
+	var body groupMsg
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
 		return err
 	}
@@ -135,45 +329,59 @@ func (s *server) listCommitedOffsetsHandler(msg maelstrom.Message) error {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	offsets := s.offsets[body.Group]
+	if offsets == nil {
+		offsets = map[string]int{}
+	}
+
 	res := map[string]any{
 		"type":    "list_committed_offsets_ok",
-		"offsets": s.offsets,
+		"offsets": offsets,
 	}
 
 	return s.n.Reply(msg, res)
 }
 
-func getOffsetIndex(entries []logEntry, startingOffset int) int {
-	left, right := 0, len(entries)-1
-
-	for left <= right {
-		mid := left + (right-left)/2
-		currentOffset := entries[mid].offset
+// listGroupsHandler returns the consumer groups with committed offsets,
+// without the default one.
+func (s *server) listGroupsHandler(msg maelstrom.Message) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-		switch {
-		case currentOffset == startingOffset:
-			return mid
-		case currentOffset < startingOffset:
-			left = mid + 1
-		default:
-			right = mid - 1
+	groups := make([]string, 0, len(s.offsets))
+	for group := range s.offsets {
+		if group != "" {
+			groups = append(groups, group)
 		}
 	}
 
-	return left
+	sort.Strings(groups)
+
+	return s.n.Reply(msg, map[string]any{
+		"type":   "list_groups_ok",
+		"groups": groups,
+	})
 }
 
-// TODO: This is not efficient we should use a binary search
-func (s *server) offsetIndex(logs []logEntry, offset int) int {
-	log.Printf("offsetIndex logs: %v", logs)
-	for i := range logs {
-		log.Printf("offsetIndex offset: %v", offset)
-		log.Printf("offsetIndex logs: %v", logs[i])
-		if logs[i].offset == offset {
-			log.Printf("found i: %v", i)
-			return i
-		}
+func (s *server) deleteGroupHandler(msg maelstrom.Message) error {
+	var body groupMsg
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.offsets[body.Group]; !exists || body.Group == "" {
+		return maelstrom.NewRPCError(maelstrom.KeyDoesNotExist,
+			fmt.Sprintf("group %q does not exist", body.Group))
 	}
 
-	return 0
+	if err := s.persist(walRecord{Op: opDeleteGroup, Group: body.Group}); err != nil {
+		return err
+	}
+
+	return s.n.Reply(msg, map[string]any{
+		"type": "delete_group_ok",
+	})
 }
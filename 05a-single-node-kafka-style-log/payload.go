@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// Messages are arbitrary JSON values, byte strings are sent as base64 JSON
+// strings. They can have string headers and a timestamp in Unix milliseconds,
+// which defaults to the time the message is appended.
+
+// msgMeta is the metadata of a message a poll returns when asked for it.
+type msgMeta struct {
+	Headers   map[string]string `json:"headers,omitempty"`
+	Timestamp int64             `json:"timestamp"`
+}
+
+// polledMsg is a message as a poll returns it: an [offset, msg] pair, with
+// its metadata as a third element when the poll asks for it.
+type polledMsg struct {
+	offset int
+	msg    json.RawMessage
+	meta   *msgMeta
+}
+
+func (m polledMsg) MarshalJSON() ([]byte, error) {
+	entry := []any{m.offset, m.msg}
+	if m.meta != nil {
+		entry = append(entry, m.meta)
+	}
+
+	return json.Marshal(entry)
+}
+
+func (e logEntry) polled(metadata bool) polledMsg {
+	m := polledMsg{offset: e.offset, msg: e.msg}
+	if metadata {
+		m.meta = &msgMeta{Headers: e.headers, Timestamp: e.time.UnixMilli()}
+	}
+
+	return m
+}
+
+// compactMsg validates a message and strips its insignificant whitespace, so
+// equal messages are stored with the same bytes.
+func compactMsg(msg json.RawMessage) (json.RawMessage, error) {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, msg); err != nil {
+		return nil, maelstrom.NewRPCError(maelstrom.MalformedRequest,
+			fmt.Sprintf("invalid msg: %v", err))
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// producerWindow is how many sequence numbers are remembered per producer
+// and key, a retry older than that can't be told apart from a new send.
+const producerWindow = 5
+
+// errSequenceTooOld is returned for a retry older than producerWindow, it has
+// its own code so it can't be mistaken for a retryable conflict.
+const errSequenceTooOld = 1001
+
+type producerKey struct {
+	producer string
+	key      string
+}
+
+type producerSeq struct {
+	seq    int
+	offset int
+}
+
+// producerState holds the latest sequence numbers a producer sent to a key
+// with the offsets they were assigned, oldest first.
+type producerState struct {
+	recent []producerSeq
+}
+
+// lookup returns the offset a send was assigned if seq was already seen,
+// sequence numbers greater than the last one are new sends.
+func (p *producerState) lookup(producer string, seq int) (int, bool, error) {
+	if p == nil || len(p.recent) == 0 || seq > p.recent[len(p.recent)-1].seq {
+		return 0, false, nil
+	}
+
+	for _, r := range p.recent {
+		if r.seq == seq {
+			return r.offset, true, nil
+		}
+	}
+
+	return 0, false, maelstrom.NewRPCError(errSequenceTooOld,
+		fmt.Sprintf("sequence %d of producer %s is too old to deduplicate", seq, producer))
+}
+
+func (p *producerState) record(seq, offset int) {
+	p.recent = append(p.recent, producerSeq{seq: seq, offset: offset})
+	if len(p.recent) > producerWindow {
+		p.recent = p.recent[1:]
+	}
+}
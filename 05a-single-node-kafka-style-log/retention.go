@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+const retentionInterval = time.Second
+
+// errOffsetTruncated is returned when polling below the start of a log.
+const errOffsetTruncated = 1000
+
+// retentionPolicy decides which entries are dropped, entries are only ever
+// dropped once every group that committed offsets for their key is past them.
+type retentionPolicy struct {
+	// maxAge drops the entries older than it, zero keeps them.
+	maxAge time.Duration
+	// maxEntries drops the oldest entries of a key beyond it, zero keeps them.
+	maxEntries int
+	// compact keeps only the latest entry of every message in a key.
+	compact bool
+}
+
+func retentionFromEnv() retentionPolicy {
+	return retentionPolicy{
+		maxAge:     time.Duration(envInt("KAFKA_RETENTION_MS", 0)) * time.Millisecond,
+		maxEntries: envInt("KAFKA_RETENTION_ENTRIES", 0),
+		compact:    envBool("KAFKA_COMPACT"),
+	}
+}
+
+func (p retentionPolicy) enabled() bool {
+	return p.maxAge > 0 || p.maxEntries > 0 || p.compact
+}
+
+func (s *server) newRetentionWorker() {
+	if !s.retention.enabled() {
+		return
+	}
+
+	go func() {
+		for range time.Tick(retentionInterval) {
+			s.enforceRetention(time.Now())
+		}
+	}()
+}
+
+func (s *server) enforceRetention(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, logs := range s.logs {
+		committed, ok := s.minCommittedOffset(key)
+		if !ok {
+			continue
+		}
+
+		// Only entries up to the committed offset can be dropped.
+		eligible := s.position(key, committed+1)
+
+		drop := 0
+		if s.retention.maxAge > 0 {
+			for drop < eligible && now.Sub(logs[drop].time) > s.retention.maxAge {
+				drop++
+			}
+		}
+
+		if s.retention.maxEntries > 0 && len(logs)-drop > s.retention.maxEntries {
+			drop = len(logs) - s.retention.maxEntries
+			if drop > eligible {
+				drop = eligible
+			}
+		}
+
+		start := s.logStart[key]
+		if drop > 0 {
+			start = logs[drop-1].offset + 1
+		}
+
+		var dropped []int
+		if s.retention.compact {
+			dropped = compacted(logs[drop:], eligible-drop)
+		}
+
+		if drop == 0 && len(dropped) == 0 {
+			continue
+		}
+
+		err := s.persist(walRecord{
+			Op:      opTruncate,
+			Key:     key,
+			Start:   start,
+			Dropped: dropped,
+		})
+		if err != nil {
+			log.Printf("retention: %v", err)
+			return
+		}
+	}
+}
+
+// compacted returns the offsets of the first n entries that have a later
+// entry with the same message.
+func compacted(logs []logEntry, n int) []int {
+	latest := make(map[string]int, len(logs))
+	for i, entry := range logs {
+		latest[string(entry.msg)] = i
+	}
+
+	var offsets []int
+	for i, entry := range logs[:n] {
+		if latest[string(entry.msg)] != i {
+			offsets = append(offsets, entry.offset)
+		}
+	}
+
+	return offsets
+}
+
+// minCommittedOffset returns the lowest offset committed for a key by any
+// group, and false if no group committed one yet.
+// The caller must hold s.mu.
+func (s *server) minCommittedOffset(key string) (int, bool) {
+	committed, found := 0, false
+
+	for _, offsets := range s.offsets {
+		offset, ok := offsets[key]
+		if !ok {
+			continue
+		}
+
+		if !found || offset < committed {
+			committed, found = offset, true
+		}
+	}
+
+	return committed, found
+}
+
+// checkTruncated fails polls for offsets that were already truncated.
+// The caller must hold s.mu.
+func (s *server) checkTruncated(key string, offset int) error {
+	if start := s.logStart[key]; offset < start {
+		return maelstrom.NewRPCError(errOffsetTruncated,
+			fmt.Sprintf("offset %d of %s was truncated, the log starts at %d", offset, key, start))
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// Append rates are averaged over the last rateBuckets seconds.
+const rateBuckets = 10
+
+// rateCounter counts events in one second buckets.
+type rateCounter struct {
+	buckets [rateBuckets]int
+	last    int64
+}
+
+func (c *rateCounter) add(now time.Time) {
+	c.advance(now.Unix())
+	c.buckets[now.Unix()%rateBuckets]++
+}
+
+// rate returns the events per second over the last rateBuckets seconds.
+func (c *rateCounter) rate(now time.Time) float64 {
+	c.advance(now.Unix())
+
+	total := 0
+	for _, count := range c.buckets {
+		total += count
+	}
+
+	return float64(total) / rateBuckets
+}
+
+// advance clears the buckets of the seconds that passed since the last
+// event.
+func (c *rateCounter) advance(second int64) {
+	if second <= c.last {
+		return
+	}
+
+	if second-c.last >= rateBuckets {
+		c.buckets = [rateBuckets]int{}
+	} else {
+		for s := c.last + 1; s <= second; s++ {
+			c.buckets[s%rateBuckets] = 0
+		}
+	}
+
+	c.last = second
+}
+
+// keyStats describes a key for operators. The high watermark is the offset
+// the next message gets, and the lag of a group is how many messages come
+// after the offset it committed. The default group has an empty name.
+type keyStats struct {
+	HighWatermark int            `json:"high_watermark"`
+	LogStart      int            `json:"log_start"`
+	Size          int            `json:"size"`
+	Bytes         int            `json:"bytes"`
+	AppendRate    float64        `json:"append_rate"`
+	Committed     map[string]int `json:"committed"`
+	Lag           map[string]int `json:"lag"`
+}
+
+type adminStatsMsg struct {
+	Type string   `json:"type"`
+	Keys []string `json:"keys,omitempty"`
+}
+
+// adminStatsHandler returns the stats of the requested keys, or of every key
+// without any.
+func (s *server) adminStatsHandler(msg maelstrom.Message) error {
+	var body adminStatsMsg
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := body.Keys
+	if len(keys) == 0 {
+		for key := range s.logs {
+			keys = append(keys, key)
+		}
+	}
+
+	now := time.Now()
+	stats := make(map[string]keyStats, len(keys))
+
+	for _, key := range keys {
+		logs := s.logs[key]
+		st := keyStats{
+			HighWatermark: s.nextOffset(key),
+			LogStart:      s.logStart[key],
+			Size:          len(logs),
+			Committed:     make(map[string]int),
+			Lag:           make(map[string]int),
+		}
+
+		if len(logs) > 0 {
+			st.LogStart = logs[0].offset
+		}
+
+		for _, entry := range logs {
+			st.Bytes += len(entry.msg)
+		}
+
+		if counter := s.appendRates[key]; counter != nil {
+			st.AppendRate = counter.rate(now)
+		}
+
+		for group, offsets := range s.offsets {
+			committed, ok := offsets[key]
+			if !ok {
+				continue
+			}
+
+			st.Committed[group] = committed
+			st.Lag[group] = 0
+			if lag := st.HighWatermark - 1 - committed; lag > 0 {
+				st.Lag[group] = lag
+			}
+		}
+
+		stats[key] = st
+	}
+
+	return s.n.Reply(msg, map[string]any{
+		"type": "admin_stats_ok",
+		"keys": stats,
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// A topic is split in partitions, each one an ordinary key named
+// <topic>/<partition>, so everything that works on keys also works on
+// partitions and the plain-key protocol keeps working next to topics.
+
+func partitionKey(topic string, partition int) string {
+	return fmt.Sprintf("%s/%d", topic, partition)
+}
+
+// partitionFor hashes the key of a message to a partition, messages with the
+// same key always go to the same partition and keep their order.
+func partitionFor(key string, partitions int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return int(h.Sum32() % uint32(partitions))
+}
+
+// checkKey rejects sends to plain keys containing a /, which is reserved for
+// the partitions of topics so a plain key can never write into one.
+func checkKey(key string) error {
+	if strings.Contains(key, "/") {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest,
+			fmt.Sprintf("key %q can't contain /, send to its topic instead", key))
+	}
+
+	return nil
+}
+
+type createTopicMsg struct {
+	Type       string `json:"type"`
+	Topic      string `json:"topic"`
+	Partitions int    `json:"partitions,omitempty"`
+}
+
+// createTopicHandler creates a topic, with one partition unless told
+// otherwise. Creating an existing topic again with the same number of
+// partitions is a no-op.
+func (s *server) createTopicHandler(msg maelstrom.Message) error {
+	var body createTopicMsg
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	if body.Partitions == 0 {
+		body.Partitions = 1
+	}
+
+	if body.Topic == "" || body.Partitions < 0 {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest,
+			fmt.Sprintf("invalid topic %q with %d partitions", body.Topic, body.Partitions))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if partitions, exists := s.topics[body.Topic]; exists {
+		if partitions != body.Partitions {
+			return maelstrom.NewRPCError(maelstrom.PreconditionFailed,
+				fmt.Sprintf("topic %s already exists with %d partitions", body.Topic, partitions))
+		}
+	} else {
+		err := s.persist(walRecord{
+			Op:         opCreateTopic,
+			Topic:      body.Topic,
+			Partitions: body.Partitions,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.n.Reply(msg, map[string]any{
+		"type": "create_topic_ok",
+	})
+}
+
+// topicPartitions returns the number of partitions of a topic.
+// The caller must hold s.mu.
+func (s *server) topicPartitions(topic string) (int, error) {
+	partitions, ok := s.topics[topic]
+	if !ok {
+		return 0, maelstrom.NewRPCError(maelstrom.KeyDoesNotExist,
+			fmt.Sprintf("topic %s does not exist", topic))
+	}
+
+	return partitions, nil
+}
+
+// subscribe adds the partitions of every topic to the offsets of a poll,
+// starting from the beginning unless the offsets already have them.
+// The caller must hold s.mu.
+func (s *server) subscribe(offsets map[string]int, topics []string) (map[string]int, error) {
+	if len(topics) == 0 {
+		return offsets, nil
+	}
+
+	subscribed := make(map[string]int, len(offsets))
+	for key, offset := range offsets {
+		subscribed[key] = offset
+	}
+
+	for _, topic := range topics {
+		partitions, err := s.topicPartitions(topic)
+		if err != nil {
+			return nil, err
+		}
+
+		for p := 0; p < partitions; p++ {
+			if _, ok := subscribed[partitionKey(topic, p)]; !ok {
+				subscribed[partitionKey(topic, p)] = 0
+			}
+		}
+	}
+
+	return subscribed, nil
+}
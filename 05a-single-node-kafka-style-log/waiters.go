@@ -0,0 +1,61 @@
+package main
+
+import "time"
+
+// maxPollWait caps how long a poll can be parked.
+const maxPollWait = 30 * time.Second
+
+// addWaiter parks a poll on the keys it reads, the returned channel gets a
+// value once a send to any of them adds a message.
+// The caller must hold s.mu.
+func (s *server) addWaiter(offsets map[string]int) chan struct{} {
+	w := make(chan struct{}, 1)
+
+	for key := range offsets {
+		s.waiters[key] = append(s.waiters[key], w)
+	}
+
+	return w
+}
+
+// notifyWaiters wakes up every poll parked on a key.
+// The caller must hold s.mu.
+func (s *server) notifyWaiters(key string) {
+	for _, w := range s.waiters[key] {
+		select {
+		case w <- struct{}{}:
+		default:
+		}
+	}
+
+	delete(s.waiters, key)
+}
+
+// wait blocks until w is notified or the timeout elapses, and then removes
+// w from the keys that didn't notify it.
+func (s *server) wait(w chan struct{}, offsets map[string]int, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-w:
+	case <-timer.C:
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range offsets {
+		waiters := s.waiters[key]
+		for i := range waiters {
+			if waiters[i] == w {
+				s.waiters[key] = append(waiters[:i:i], waiters[i+1:]...)
+				break
+			}
+		}
+
+		if len(s.waiters[key]) == 0 {
+			delete(s.waiters, key)
+		}
+	}
+}
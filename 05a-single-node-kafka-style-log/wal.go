@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The write-ahead log is enabled by setting KAFKA_WAL_DIR, every change to
+// the logs, the committed offsets and the topics is appended to
+// <dir>/kafka.wal before it's applied and replayed from it on startup.
+// KAFKA_WAL_FSYNC picks when the file is synced to disk:
+//
+//   - always (the default): before replying to every request that changed it.
+//   - interval: every KAFKA_WAL_FSYNC_MS milliseconds, 1000 by default.
+//   - never: left to the operating system.
+const walFile = "kafka.wal"
+
+const (
+	fsyncAlways   = "always"
+	fsyncInterval = "interval"
+	fsyncNever    = "never"
+)
+
+// Every record is framed as its length and the CRC-32 of its payload, both
+// big endian uint32, followed by the JSON encoded record.
+const walHeaderSize = 8
+
+const (
+	opSend        = "send"
+	opCommit      = "commit"
+	opDeleteGroup = "delete_group"
+	opTruncate    = "truncate"
+	opCreateTopic = "create_topic"
+)
+
+// walRecord is a change to the server state, the fields used depend on Op.
+type walRecord struct {
+	Op string `json:"op"`
+
+	// send
+	Key      string            `json:"key,omitempty"`
+	Offset   int               `json:"offset,omitempty"`
+	Msg      json.RawMessage   `json:"msg,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Time     int64             `json:"time,omitempty"`
+	Producer string            `json:"producer,omitempty"`
+	Seq      int               `json:"seq,omitempty"`
+
+	// commit and delete_group
+	Group   string         `json:"group,omitempty"`
+	Offsets map[string]int `json:"offsets,omitempty"`
+
+	// truncate drops the entries of Key before Start and the Dropped ones.
+	Start   int   `json:"start,omitempty"`
+	Dropped []int `json:"dropped,omitempty"`
+
+	// create_topic
+	Topic      string `json:"topic,omitempty"`
+	Partitions int    `json:"partitions,omitempty"`
+}
+
+// wal appends to the end of the valid records, size. Once it fails in a
+// way it can't roll back from, err is set and every later append fails, an
+// append after a torn record would be lost on replay.
+type wal struct {
+	f      *os.File
+	policy string
+	size   int64
+	err    error
+}
+
+// openWAL replays the write-ahead log in dir and opens it for appending.
+// A torn or corrupt record at the end, left by a crash in the middle of a
+// write, is truncated along with everything after it.
+func openWAL(dir, policy string, replay func(walRecord)) (*wal, error) {
+	switch policy {
+	case fsyncAlways, fsyncInterval, fsyncNever:
+	default:
+		return nil, fmt.Errorf("invalid fsync policy %q", policy)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, walFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	valid, err := replayWAL(f, replay)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &wal{f: f, policy: policy, size: valid}, nil
+}
+
+// replayWAL calls replay with every valid record and returns the size of
+// the valid part of the file.
+func replayWAL(f *os.File, replay func(walRecord)) (int64, error) {
+	r := bufio.NewReader(f)
+	header := make([]byte, walHeaderSize)
+	var valid int64
+
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return valid, nil
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				log.Printf("wal: truncating torn record header at %d", valid)
+				return valid, nil
+			}
+
+			return 0, err
+		}
+
+		size := binary.BigEndian.Uint32(header[0:4])
+		sum := binary.BigEndian.Uint32(header[4:8])
+
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				log.Printf("wal: truncating torn record at %d", valid)
+				return valid, nil
+			}
+
+			return 0, err
+		}
+
+		var rec walRecord
+		if crc32.ChecksumIEEE(payload) != sum || json.Unmarshal(payload, &rec) != nil {
+			log.Printf("wal: truncating corrupt record at %d", valid)
+			return valid, nil
+		}
+
+		replay(rec)
+		valid += walHeaderSize + int64(size)
+	}
+}
+
+func (w *wal) append(rec walRecord) error {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[walHeaderSize:], payload)
+
+	if w.err != nil {
+		return fmt.Errorf("wal failed: %w", w.err)
+	}
+
+	if _, err := w.f.Write(buf); err != nil {
+		w.rollback(err)
+		return err
+	}
+
+	if w.policy == fsyncAlways {
+		if err := w.f.Sync(); err != nil {
+			// What reached the disk is unknown after a failed fsync, so the
+			// log isn't trusted any more even if the rollback works.
+			w.rollback(err)
+			w.err = err
+			return err
+		}
+	}
+
+	w.size += int64(len(buf))
+
+	return nil
+}
+
+// rollback truncates a partly written record so the next append doesn't
+// land after it, or fails the log if that doesn't work either.
+func (w *wal) rollback(cause error) {
+	if err := w.f.Truncate(w.size); err != nil {
+		log.Printf("wal: truncate after %v: %v", cause, err)
+		w.err = cause
+		return
+	}
+
+	if _, err := w.f.Seek(w.size, io.SeekStart); err != nil {
+		log.Printf("wal: seek after %v: %v", cause, err)
+		w.err = cause
+	}
+}
+
+func (w *wal) newSyncWorker(interval time.Duration) {
+	if w.policy != fsyncInterval {
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			if err := w.f.Sync(); err != nil {
+				log.Printf("wal: sync: %v", err)
+			}
+		}
+	}()
+}
+
+// openWAL replays and opens the write-ahead log if KAFKA_WAL_DIR is set.
+// It runs before the node handles any message.
+func (s *server) openWAL() error {
+	dir := os.Getenv("KAFKA_WAL_DIR")
+	if dir == "" {
+		return nil
+	}
+
+	policy := os.Getenv("KAFKA_WAL_FSYNC")
+	if policy == "" {
+		policy = fsyncAlways
+	}
+
+	w, err := openWAL(dir, policy, s.apply)
+	if err != nil {
+		return fmt.Errorf("open wal: %w", err)
+	}
+
+	w.newSyncWorker(time.Duration(envInt("KAFKA_WAL_FSYNC_MS", 1000)) * time.Millisecond)
+	s.wal = w
+
+	return nil
+}
+
+// persist appends a change to the write-ahead log, if enabled, and then
+// applies it.
+// The caller must hold s.mu.
+func (s *server) persist(rec walRecord) error {
+	if s.wal != nil {
+		if err := s.wal.append(rec); err != nil {
+			return err
+		}
+	}
+
+	s.apply(rec)
+
+	return nil
+}
+
+// apply changes the server state, both for new requests and when replaying
+// the write-ahead log.
+// The caller must hold s.mu, or be replaying before the node runs.
+func (s *server) apply(rec walRecord) {
+	switch rec.Op {
+	case opSend:
+		entry := logEntry{
+			offset:  rec.Offset,
+			msg:     rec.Msg,
+			headers: rec.Headers,
+			time:    time.UnixMilli(rec.Time),
+		}
+		s.logs[rec.Key] = append(s.logs[rec.Key], entry)
+		s.indexes[rec.Key] = addToIndex(s.indexes[rec.Key], entry, len(s.logs[rec.Key])-1)
+		s.notifyWaiters(rec.Key)
+
+		if rec.Producer != "" {
+			pk := producerKey{producer: rec.Producer, key: rec.Key}
+			if s.producers[pk] == nil {
+				s.producers[pk] = &producerState{}
+			}
+
+			s.producers[pk].record(rec.Seq, rec.Offset)
+		}
+
+	case opCommit:
+		if s.offsets[rec.Group] == nil {
+			s.offsets[rec.Group] = make(map[string]int)
+		}
+
+		for k, v := range rec.Offsets {
+			s.offsets[rec.Group][k] = v
+		}
+
+	case opDeleteGroup:
+		delete(s.offsets, rec.Group)
+
+	case opTruncate:
+		dropped := make(map[int]bool, len(rec.Dropped))
+		for _, offset := range rec.Dropped {
+			dropped[offset] = true
+		}
+
+		kept := make([]logEntry, 0, len(s.logs[rec.Key]))
+		for _, entry := range s.logs[rec.Key] {
+			if entry.offset >= rec.Start && !dropped[entry.offset] {
+				kept = append(kept, entry)
+			}
+		}
+
+		s.logs[rec.Key] = kept
+		s.logStart[rec.Key] = rec.Start
+		s.reindex(rec.Key)
+
+	case opCreateTopic:
+		s.topics[rec.Topic] = rec.Partitions
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newReplayServer returns a server with the state apply changes, like the
+// one main builds before replaying the write-ahead log.
+func newReplayServer() *server {
+	return &server{
+		logs:      make(map[string][]logEntry),
+		indexes:   make(map[string][]indexEntry),
+		offsets:   make(map[string]map[string]int),
+		topics:    make(map[string]int),
+		logStart:  make(map[string]int),
+		waiters:   make(map[string][]chan struct{}),
+		producers: make(map[producerKey]*producerState),
+	}
+}
+
+// writeWAL appends recs to a new write-ahead log in dir.
+func writeWAL(t *testing.T, dir string, recs ...walRecord) {
+	t.Helper()
+
+	w, err := openWAL(dir, fsyncNever, func(walRecord) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.f.Close()
+
+	for _, rec := range recs {
+		if err := w.append(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// replayAll reopens the write-ahead log in dir and returns the records it
+// replayed and the log, which the caller must close.
+func replayAll(t *testing.T, dir string) ([]walRecord, *wal) {
+	t.Helper()
+
+	var recs []walRecord
+	w, err := openWAL(dir, fsyncNever, func(rec walRecord) {
+		recs = append(recs, rec)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return recs, w
+}
+
+func sendRecord(offset int, msg string) walRecord {
+	return walRecord{Op: opSend, Key: "a", Offset: offset, Msg: json.RawMessage(msg), Time: 1000}
+}
+
+// TestWALReplayAppliesRecords replays sends, a commit and a truncation into
+// a new server and checks it ends up in the state they describe.
+func TestWALReplayAppliesRecords(t *testing.T) {
+	dir := t.TempDir()
+
+	producerSend := sendRecord(2, `"c"`)
+	producerSend.Producer, producerSend.Seq = "p1", 7
+
+	writeWAL(t, dir,
+		sendRecord(0, `"a"`),
+		sendRecord(1, `"b"`),
+		producerSend,
+		walRecord{Op: opCommit, Group: "g", Offsets: map[string]int{"a": 1}},
+		walRecord{Op: opTruncate, Key: "a", Start: 1},
+	)
+
+	s := newReplayServer()
+	w, err := openWAL(dir, fsyncNever, s.apply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.f.Close()
+
+	var offsets []int
+	for _, entry := range s.logs["a"] {
+		offsets = append(offsets, entry.offset)
+	}
+	if !reflect.DeepEqual(offsets, []int{1, 2}) {
+		t.Errorf("offsets of a = %v, want [1 2]", offsets)
+	}
+
+	if got := s.offsets["g"]["a"]; got != 1 {
+		t.Errorf("committed offset of a in g = %d, want 1", got)
+	}
+
+	if got := s.logStart["a"]; got != 1 {
+		t.Errorf("log start of a = %d, want 1", got)
+	}
+
+	offset, found, err := s.producers[producerKey{producer: "p1", key: "a"}].lookup("p1", 7)
+	if err != nil || !found || offset != 2 {
+		t.Errorf("lookup of p1 seq 7 = %d, %v, %v, want 2, true, nil", offset, found, err)
+	}
+}
+
+// TestWALTruncatesDamagedTail damages the end of the log the ways a crash
+// or a bad disk can and checks the valid records are replayed, the rest is
+// truncated and new records land right after the valid ones.
+func TestWALTruncatesDamagedTail(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(t *testing.T, path string, valid int64)
+	}{
+		{
+			name: "torn header",
+			damage: func(t *testing.T, path string, valid int64) {
+				appendBytes(t, path, []byte{0, 0, 0})
+			},
+		},
+		{
+			name: "torn payload",
+			damage: func(t *testing.T, path string, valid int64) {
+				header := make([]byte, walHeaderSize)
+				binary.BigEndian.PutUint32(header[0:4], 100)
+				appendBytes(t, path, append(header, `{"op":"se`...))
+			},
+		},
+		{
+			name: "crc mismatch",
+			damage: func(t *testing.T, path string, valid int64) {
+				writeWAL(t, filepath.Dir(path), sendRecord(2, `"c"`))
+
+				f, err := os.OpenFile(path, os.O_RDWR, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+
+				// Flip a byte of the payload of the last record.
+				b := make([]byte, 1)
+				if _, err := f.ReadAt(b, valid+walHeaderSize+1); err != nil {
+					t.Fatal(err)
+				}
+				b[0] ^= 0xff
+				if _, err := f.WriteAt(b, valid+walHeaderSize+1); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, walFile)
+
+			writeWAL(t, dir, sendRecord(0, `"a"`), sendRecord(1, `"b"`))
+
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			valid := info.Size()
+
+			tt.damage(t, path, valid)
+
+			recs, w := replayAll(t, dir)
+			if len(recs) != 2 {
+				t.Fatalf("replayed %d records, want 2", len(recs))
+			}
+
+			if w.size != valid {
+				t.Errorf("valid size = %d, want %d", w.size, valid)
+			}
+
+			if err := w.append(sendRecord(2, `"d"`)); err != nil {
+				t.Fatal(err)
+			}
+			w.f.Close()
+
+			recs, w = replayAll(t, dir)
+			defer w.f.Close()
+
+			if len(recs) != 3 || string(recs[2].Msg) != `"d"` {
+				t.Fatalf("replayed %v after appending, want the 2 valid records and the new one", recs)
+			}
+		})
+	}
+}
+
+func appendBytes(t *testing.T, path string, b []byte) {
+	t.Helper()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
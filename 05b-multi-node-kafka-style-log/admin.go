@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// Truncating a log moves its start register at <key>/start forward with a
+// compare-and-swap, every node checks it when reading the log so a truncation
+// is seen by all of them at once. lin-kv can't delete keys so the segments
+// stay as they are, and offsets keep growing after the dropped entries.
+
+// errOffsetTruncated is returned when polling below the start of a log.
+const errOffsetTruncated = 1000
+
+func startKey(key string) string {
+	return metaKey(key, "start")
+}
+
+// logStart returns the first offset of a log that wasn't truncated.
+func (s *server) logStart(ctx context.Context, key string) (int, error) {
+	start, err := s.lKv.ReadInt(ctx, startKey(key))
+	if err != nil {
+		if maelstrom.ErrorCode(err) == maelstrom.KeyDoesNotExist {
+			return 0, nil
+		}
+
+		return 0, err
+	}
+
+	return start, nil
+}
+
+// checkTruncated fails reads for offsets that were already truncated.
+func (s *server) checkTruncated(ctx context.Context, key string, offset int) error {
+	start, err := s.logStart(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if offset < start {
+		return maelstrom.NewRPCError(errOffsetTruncated,
+			fmt.Sprintf("offset %d of %s was truncated, the log starts at %d", offset, key, start))
+	}
+
+	return nil
+}
+
+// latestOffset returns the offset of the last entry of a key, or -1 if it
+// has none yet.
+func (s *server) latestOffset(ctx context.Context, key string) (int, error) {
+	latest, err := s.lKv.ReadInt(ctx, offsetKey(key))
+	if err != nil {
+		if maelstrom.ErrorCode(err) == maelstrom.KeyDoesNotExist {
+			return -1, nil
+		}
+
+		return 0, err
+	}
+
+	return latest, nil
+}
+
+type truncateMsg struct {
+	Type   string `json:"type"`
+	Key    string `json:"key"`
+	Offset int    `json:"offset,omitempty"`
+}
+
+// deleteKeyHandler drops every entry a key has so far.
+func (s *server) deleteKeyHandler(msg maelstrom.Message) error {
+	var body truncateMsg
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	latest, err := s.latestOffset(ctx, body.Key)
+	if err != nil {
+		return err
+	}
+
+	if latest < 0 {
+		return maelstrom.NewRPCError(maelstrom.KeyDoesNotExist,
+			fmt.Sprintf("key %s does not exist", body.Key))
+	}
+
+	start, err := s.truncate(ctx, body.Key, latest+1)
+	if err != nil {
+		return err
+	}
+
+	return s.n.Reply(msg, map[string]any{
+		"type":      "delete_key_ok",
+		"log_start": start,
+	})
+}
+
+// truncateBeforeHandler drops the entries of a key before an offset, the
+// offset can be at most the one the next entry gets.
+func (s *server) truncateBeforeHandler(msg maelstrom.Message) error {
+	var body truncateMsg
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	latest, err := s.latestOffset(ctx, body.Key)
+	if err != nil {
+		return err
+	}
+
+	if body.Offset > latest+1 {
+		return maelstrom.NewRPCError(maelstrom.PreconditionFailed,
+			fmt.Sprintf("offset %d of %s is past its end at %d", body.Offset, body.Key, latest+1))
+	}
+
+	start, err := s.truncate(ctx, body.Key, body.Offset)
+	if err != nil {
+		return err
+	}
+
+	return s.n.Reply(msg, map[string]any{
+		"type":      "truncate_before_ok",
+		"log_start": start,
+	})
+}
+
+// truncate moves the start of a log forward to offset and returns the new
+// start, truncating before the current start is a no-op.
+func (s *server) truncate(ctx context.Context, key string, offset int) (int, error) {
+	for {
+		start, err := s.logStart(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+
+		if offset <= start {
+			return start, nil
+		}
+
+		err = s.lKv.CompareAndSwap(ctx, startKey(key), start, offset, true)
+		if err == nil {
+			return offset, nil
+		}
+
+		if maelstrom.ErrorCode(err) != maelstrom.PreconditionFailed {
+			return 0, err
+		}
+	}
+}
+
+const (
+	resetEarliest = "earliest"
+	resetLatest   = "latest"
+)
+
+type resetOffsetsMsg struct {
+	Type   string          `json:"type"`
+	Group  string          `json:"group,omitempty"`
+	Key    string          `json:"key"`
+	Offset json.RawMessage `json:"offset"`
+}
+
+// resetOffsetsHandler replaces the committed offset of a group, unlike
+// commit_offsets it can move it backwards. The offset is a number, earliest
+// to consume the key again from the start of its log or latest to skip to
+// its end. Committed offsets are the last one consumed, so both commit the
+// offset before.
+func (s *server) resetOffsetsHandler(msg maelstrom.Message) error {
+	var body resetOffsetsMsg
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	offset, err := s.resetOffset(ctx, body.Key, body.Offset)
+	if err != nil {
+		return err
+	}
+
+	generation, err := s.groupGeneration(ctx, body.Group, true)
+	if err != nil {
+		return err
+	}
+
+	if err := s.resetCommitted(ctx, committedKey(body.Key, body.Group, generation), offset); err != nil {
+		return err
+	}
+
+	return s.n.Reply(msg, map[string]any{
+		"type":   "reset_offsets_ok",
+		"offset": offset,
+	})
+}
+
+// resetOffset resolves the offset of a reset_offsets request.
+func (s *server) resetOffset(ctx context.Context, key string, raw json.RawMessage) (int, error) {
+	var offset int
+	if err := json.Unmarshal(raw, &offset); err == nil {
+		return offset, nil
+	}
+
+	var position string
+	if err := json.Unmarshal(raw, &position); err == nil {
+		switch position {
+		case resetEarliest:
+			start, err := s.logStart(ctx, key)
+			return start - 1, err
+		case resetLatest:
+			return s.latestOffset(ctx, key)
+		}
+	}
+
+	return 0, maelstrom.NewRPCError(maelstrom.MalformedRequest,
+		fmt.Sprintf("invalid offset %s, expected a number, %q or %q", raw, resetEarliest, resetLatest))
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// maxCachedSegments bounds how many full segments a node caches, the ones
+// cached first are evicted first.
+const maxCachedSegments = 1000
+
+type segmentID struct {
+	key string
+	n   int
+}
+
+// segmentCache lets any node serve polls without asking the leaders or
+// decoding the same segments from lin-kv again. Full segments never change
+// so they are cached until evicted. The tail of a key is cached with the
+// segment index and is only used while its last offset still matches the
+// latest offset register, which every send moves before writing the tail.
+type segmentCache struct {
+	sealed map[segmentID][]logEntry
+	order  []segmentID
+	tails  map[string]cachedTail
+
+	mu sync.Mutex
+}
+
+type cachedTail struct {
+	segments []segmentInfo
+	entries  []logEntry
+}
+
+func newSegmentCache() *segmentCache {
+	return &segmentCache{
+		sealed: make(map[segmentID][]logEntry),
+		tails:  make(map[string]cachedTail),
+	}
+}
+
+// tail returns the cached tail of a key if it ends at the latest offset.
+func (c *segmentCache) tail(key string, latest int) (cachedTail, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tail, ok := c.tails[key]
+	if !ok || len(tail.entries) == 0 || tail.entries[len(tail.entries)-1].Offset != latest {
+		return cachedTail{}, false
+	}
+
+	return tail, true
+}
+
+func (c *segmentCache) setTail(key string, tail cachedTail) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tails[key] = tail
+}
+
+func (c *segmentCache) segment(id segmentID) ([]logEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	segment, ok := c.sealed[id]
+	return segment, ok
+}
+
+func (c *segmentCache) setSegment(id segmentID, segment []logEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.sealed[id]; ok {
+		return
+	}
+
+	if len(c.order) >= maxCachedSegments {
+		delete(c.sealed, c.order[0])
+		c.order = c.order[1:]
+	}
+
+	c.sealed[id] = segment
+	c.order = append(c.order, id)
+}
+
+// cachedLog returns the entries of a key from offset onwards, reading from
+// lin-kv only the segments that aren't cached or changed since, and no more
+// of them than a poll with limits can return. It fails for offsets before
+// the start of the log, which isn't cached as truncating doesn't change the
+// segments.
+func (s *server) cachedLog(ctx context.Context, key string, offset int, limits pollLimits) ([]logEntry, error) {
+	if err := s.checkTruncated(ctx, key, offset); err != nil {
+		return nil, err
+	}
+
+	latest, err := s.lKv.ReadInt(ctx, offsetKey(key))
+	if err != nil {
+		if maelstrom.ErrorCode(err) == maelstrom.KeyDoesNotExist {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	tail, ok := s.cache.tail(key, latest)
+	if !ok {
+		if tail, err = s.fetchTail(ctx, key, latest); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(tail.segments) == 0 {
+		return nil, nil
+	}
+
+	last := len(tail.segments) - 1
+	recent := tail.entries[getOffsetIndex(tail.entries, offset):]
+
+	if offset >= tail.segments[last].Base {
+		return recent, nil
+	}
+
+	var entries []logEntry
+	count, size := 0, 0
+
+	for n := segmentFor(tail.segments, offset); n < last && !limits.reached(count, size); n++ {
+		segment, err := s.sealedSegment(ctx, key, n)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range segment[getOffsetIndex(segment, offset):] {
+			entries = append(entries, entry)
+
+			if entry.Txn == "" {
+				count++
+				size += len(entry.Msg)
+			}
+		}
+	}
+
+	return append(entries, recent...), nil
+}
+
+// reached reports whether count messages of size bytes fill a poll from a
+// single key. Only entries outside transactions are counted since the ones
+// of aborted transactions are skipped, and the size of a message is less
+// than its size in the reply.
+func (l pollLimits) reached(count, size int) bool {
+	return l.MaxMessages > 0 && count >= l.MaxMessages ||
+		l.MaxBytes > 0 && size > l.MaxBytes
+}
+
+// fetchTail reads the segment index and the tail segment of a key, and
+// caches them if the tail has every entry up to the latest offset. A send
+// that reserved its offset but didn't write the tail yet leaves it uncached.
+func (s *server) fetchTail(ctx context.Context, key string, latest int) (cachedTail, error) {
+	var tail cachedTail
+	if _, err := s.readJSON(ctx, segmentsKey(key), &tail.segments); err != nil {
+		return cachedTail{}, err
+	}
+
+	if len(tail.segments) > 0 {
+		if _, err := s.readJSON(ctx, segmentKey(key, len(tail.segments)-1), &tail.entries); err != nil {
+			return cachedTail{}, err
+		}
+	}
+
+	if len(tail.entries) > 0 && tail.entries[len(tail.entries)-1].Offset == latest {
+		s.cache.setTail(key, tail)
+	}
+
+	return tail, nil
+}
+
+// sealedSegment returns a full segment of a key, the caller must only ask
+// for segments before the tail.
+func (s *server) sealedSegment(ctx context.Context, key string, n int) ([]logEntry, error) {
+	id := segmentID{key: key, n: n}
+	if segment, ok := s.cache.segment(id); ok {
+		return segment, nil
+	}
+
+	var segment []logEntry
+	if _, err := s.readJSON(ctx, segmentKey(key, n), &segment); err != nil {
+		return nil, err
+	}
+
+	s.cache.setSegment(id, segment)
+
+	return segment, nil
+}
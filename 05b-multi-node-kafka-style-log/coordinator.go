@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// The coordinator of a consumer group is the leader of the key
+// group/<name>, it keeps the members of the group in memory and splits the
+// keys they subscribe to between them. Members that stop sending heartbeats
+// for their session timeout are removed and their keys reassigned.
+//
+// Membership isn't replicated, but the coordinator and the epoch of every
+// group are kept in a register in lin-kv. A node checks it before answering
+// a member and compare-and-swaps it on every rebalance, so once another
+// node takes a group over the previous coordinator stops answering for it.
+// The new coordinator starts the group empty and the members join it again.
+
+const (
+	defaultSessionTimeout = 3 * time.Second
+	sessionCheckInterval  = 500 * time.Millisecond
+)
+
+const (
+	strategyRange      = "range"
+	strategyRoundRobin = "round_robin"
+)
+
+type groupMember struct {
+	keys     []string
+	timeout  time.Duration
+	lastSeen time.Time
+}
+
+// consumerGroup is the state of a group on its coordinator, the epoch grows
+// with every rebalance so members can tell their assignment changed.
+// claimed is set while the register of the group names this node with the
+// same epoch, mu is held across the lin-kv calls that check it.
+type consumerGroup struct {
+	strategy   string
+	epoch      int
+	members    map[string]*groupMember
+	assignment map[string][]string
+	claimed    bool
+
+	mu sync.Mutex
+}
+
+// coordinatorState is the register of a group in lin-kv.
+type coordinatorState struct {
+	Node  string `json:"Node"`
+	Epoch int    `json:"Epoch"`
+}
+
+func (s *server) coordinatorOf(group string) string {
+	return s.ownerOf("group/" + group)
+}
+
+func coordinatorKey(group string) string {
+	return metaKey("group/"+group, "coordinator")
+}
+
+// coordinate returns a group locked, once the register in lin-kv confirms
+// this node coordinates it. If another node coordinated it last, this node
+// takes it over with the same epoch and no members.
+func (s *server) coordinate(ctx context.Context, group string) (*consumerGroup, error) {
+	s.mu.Lock()
+	g := s.consumerGroups[group]
+	if g == nil {
+		g = &consumerGroup{}
+		s.consumerGroups[group] = g
+	}
+	s.mu.Unlock()
+
+	g.mu.Lock()
+
+	var state coordinatorState
+	if _, err := s.readJSON(ctx, coordinatorKey(group), &state); err != nil {
+		g.mu.Unlock()
+		return nil, err
+	}
+
+	if g.claimed && state == (coordinatorState{Node: s.n.ID(), Epoch: g.epoch}) {
+		return g, nil
+	}
+
+	next := coordinatorState{Node: s.n.ID(), Epoch: state.Epoch}
+	if err := s.casJSON(ctx, coordinatorKey(group), state, next); err != nil {
+		g.mu.Unlock()
+
+		if maelstrom.ErrorCode(err) == maelstrom.PreconditionFailed {
+			return nil, maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable,
+				fmt.Sprintf("another node took group %s over, retry", group))
+		}
+
+		return nil, err
+	}
+
+	g.strategy = ""
+	g.epoch = state.Epoch
+	g.members = make(map[string]*groupMember)
+	g.assignment = nil
+	g.claimed = true
+
+	return g, nil
+}
+
+// rebalance reassigns the keys of a group with the next epoch, which it
+// writes to the register first. If that fails the group may belong to
+// another node now, so it has to be claimed again before its next use.
+// The caller must hold g.mu.
+func (s *server) rebalance(ctx context.Context, group string, g *consumerGroup) error {
+	current := coordinatorState{Node: s.n.ID(), Epoch: g.epoch}
+	next := coordinatorState{Node: s.n.ID(), Epoch: g.epoch + 1}
+
+	if err := s.casJSON(ctx, coordinatorKey(group), current, next); err != nil {
+		g.claimed = false
+		return err
+	}
+
+	g.epoch = next.Epoch
+	g.assignment = assignKeys(g.strategy, g.members)
+
+	return nil
+}
+
+type joinGroupMsg struct {
+	Type             string   `json:"type"`
+	Group            string   `json:"group"`
+	MemberID         string   `json:"member_id,omitempty"`
+	Keys             []string `json:"keys,omitempty"`
+	Topics           []string `json:"topics,omitempty"`
+	Strategy         string   `json:"strategy,omitempty"`
+	SessionTimeoutMs int      `json:"session_timeout_ms,omitempty"`
+	Forwarded        bool     `json:"forwarded,omitempty"`
+}
+
+// joinGroupHandler adds a member to a group, or updates its subscription,
+// and replies with its member ID and the keys assigned to it. The first
+// member picks the assignment strategy of the group.
+func (s *server) joinGroupHandler(msg maelstrom.Message) error {
+	var body joinGroupMsg
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	if !body.Forwarded {
+		body.Forwarded = true
+
+		res, err := s.leaderRPC(s.coordinatorOf(body.Group), body)
+		if err != nil {
+			return err
+		}
+
+		if res != nil {
+			return s.n.Reply(msg, res.Body)
+		}
+	}
+
+	if body.Strategy == "" {
+		body.Strategy = strategyRange
+	}
+
+	if body.Strategy != strategyRange && body.Strategy != strategyRoundRobin {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest,
+			fmt.Sprintf("unknown assignment strategy %q", body.Strategy))
+	}
+
+	sessionTimeout := defaultSessionTimeout
+	if body.SessionTimeoutMs > 0 {
+		sessionTimeout = time.Duration(body.SessionTimeoutMs) * time.Millisecond
+	}
+
+	// Topics are expanded before taking the lock, reading them can go to lin-kv.
+	subscribed, err := s.subscribe(map[string]int{}, body.Topics)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range body.Keys {
+		subscribed[key] = 0
+	}
+
+	keys := make([]string, 0, len(subscribed))
+	for key := range subscribed {
+		keys = append(keys, key)
+	}
+	sortKeys(keys)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	g, err := s.coordinate(ctx, body.Group)
+	if err != nil {
+		return err
+	}
+	defer g.mu.Unlock()
+
+	if len(g.members) == 0 {
+		g.strategy = body.Strategy
+	}
+
+	if g.strategy != body.Strategy {
+		return maelstrom.NewRPCError(maelstrom.PreconditionFailed,
+			fmt.Sprintf("group %s uses the %s strategy", body.Group, g.strategy))
+	}
+
+	memberID := body.MemberID
+	if memberID == "" {
+		s.mu.Lock()
+		s.memberSeq++
+		memberID = fmt.Sprintf("%s-%d-%d", s.n.ID(), time.Now().UnixNano(), s.memberSeq)
+		s.mu.Unlock()
+	}
+
+	m, exists := g.members[memberID]
+	if !exists || strings.Join(m.keys, "\x00") != strings.Join(keys, "\x00") {
+		g.members[memberID] = &groupMember{keys: keys}
+		if err := s.rebalance(ctx, body.Group, g); err != nil {
+			return err
+		}
+	}
+
+	m = g.members[memberID]
+	m.timeout = sessionTimeout
+	m.lastSeen = time.Now()
+
+	return s.n.Reply(msg, map[string]any{
+		"type":       "join_group_ok",
+		"member_id":  memberID,
+		"epoch":      g.epoch,
+		"assignment": memberAssignment(g, memberID),
+	})
+}
+
+type memberMsg struct {
+	Type      string `json:"type"`
+	Group     string `json:"group"`
+	MemberID  string `json:"member_id"`
+	Forwarded bool   `json:"forwarded,omitempty"`
+}
+
+// heartbeatHandler keeps a member in its group and replies with its current
+// assignment, members that aren't in the group have to join it again.
+func (s *server) heartbeatHandler(msg maelstrom.Message) error {
+	var body memberMsg
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	if !body.Forwarded {
+		body.Forwarded = true
+
+		res, err := s.leaderRPC(s.coordinatorOf(body.Group), body)
+		if err != nil {
+			return err
+		}
+
+		if res != nil {
+			return s.n.Reply(msg, res.Body)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	g, err := s.coordinate(ctx, body.Group)
+	if err != nil {
+		return err
+	}
+	defer g.mu.Unlock()
+
+	m, err := g.member(body.Group, body.MemberID)
+	if err != nil {
+		return err
+	}
+
+	m.lastSeen = time.Now()
+
+	return s.n.Reply(msg, map[string]any{
+		"type":       "heartbeat_ok",
+		"epoch":      g.epoch,
+		"assignment": memberAssignment(g, body.MemberID),
+	})
+}
+
+// leaveGroupHandler removes a member from its group and reassigns its keys
+// to the other members right away.
+func (s *server) leaveGroupHandler(msg maelstrom.Message) error {
+	var body memberMsg
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	if !body.Forwarded {
+		body.Forwarded = true
+
+		res, err := s.leaderRPC(s.coordinatorOf(body.Group), body)
+		if err != nil {
+			return err
+		}
+
+		if res != nil {
+			return s.n.Reply(msg, res.Body)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	g, err := s.coordinate(ctx, body.Group)
+	if err != nil {
+		return err
+	}
+	defer g.mu.Unlock()
+
+	if _, err := g.member(body.Group, body.MemberID); err != nil {
+		return err
+	}
+
+	delete(g.members, body.MemberID)
+	if err := s.rebalance(ctx, body.Group, g); err != nil {
+		return err
+	}
+
+	return s.n.Reply(msg, map[string]any{
+		"type": "leave_group_ok",
+	})
+}
+
+// member returns a member of the group, failing with KeyDoesNotExist if it
+// isn't in the group on this coordinator.
+// The caller must hold g.mu.
+func (g *consumerGroup) member(group, memberID string) (*groupMember, error) {
+	if g.members[memberID] == nil {
+		return nil, maelstrom.NewRPCError(maelstrom.KeyDoesNotExist,
+			fmt.Sprintf("member %s is not in group %s, join it again", memberID, group))
+	}
+
+	return g.members[memberID], nil
+}
+
+func memberAssignment(g *consumerGroup, memberID string) []string {
+	if keys := g.assignment[memberID]; keys != nil {
+		return keys
+	}
+
+	return []string{}
+}
+
+func (s *server) newSessionWorker() {
+	go func() {
+		for range time.Tick(sessionCheckInterval) {
+			s.expireMembers(time.Now())
+		}
+	}()
+}
+
+// expireMembers removes the members whose session timed out and rebalances
+// the groups this node still coordinates.
+func (s *server) expireMembers(now time.Time) {
+	s.mu.Lock()
+	groups := make(map[string]*consumerGroup, len(s.consumerGroups))
+	for name, g := range s.consumerGroups {
+		groups[name] = g
+	}
+	s.mu.Unlock()
+
+	for name, g := range groups {
+		g.mu.Lock()
+
+		expired := false
+		for id, m := range g.members {
+			if now.Sub(m.lastSeen) > m.timeout {
+				delete(g.members, id)
+				expired = true
+			}
+		}
+
+		if expired && g.claimed {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			if err := s.rebalance(ctx, name, g); err != nil {
+				log.Printf("rebalance group %s: %v", name, err)
+			}
+			cancel()
+		}
+
+		g.mu.Unlock()
+	}
+}
+
+// assignKeys splits the keys the members subscribe to between them.
+//
+// The range strategy splits every set of keys with the same subscribers in
+// contiguous ranges, one per subscriber, so the partitions of a topic are
+// split like Kafka's range assignor. The round robin strategy deals all keys
+// out in order to their subscribers in turn, which spreads them more evenly
+// when members subscribe to different keys.
+func assignKeys(strategy string, members map[string]*groupMember) map[string][]string {
+	memberIDs := make([]string, 0, len(members))
+	subscribers := make(map[string][]string)
+
+	for id := range members {
+		memberIDs = append(memberIDs, id)
+	}
+	sort.Strings(memberIDs)
+
+	for _, id := range memberIDs {
+		for _, key := range members[id].keys {
+			subscribers[key] = append(subscribers[key], id)
+		}
+	}
+
+	keys := make([]string, 0, len(subscribers))
+	for key := range subscribers {
+		keys = append(keys, key)
+	}
+	sortKeys(keys)
+
+	assignment := make(map[string][]string, len(members))
+
+	switch strategy {
+	case strategyRoundRobin:
+		next := 0
+		for _, key := range keys {
+			for !contains(subscribers[key], memberIDs[next%len(memberIDs)]) {
+				next++
+			}
+
+			id := memberIDs[next%len(memberIDs)]
+			assignment[id] = append(assignment[id], key)
+			next++
+		}
+
+	default:
+		sets := make(map[string][]string)
+		var order []string
+
+		for _, key := range keys {
+			set := strings.Join(subscribers[key], "\x00")
+			if _, ok := sets[set]; !ok {
+				order = append(order, set)
+			}
+			sets[set] = append(sets[set], key)
+		}
+
+		for _, set := range order {
+			ids, keys := strings.Split(set, "\x00"), sets[set]
+
+			start := 0
+			for i, id := range ids {
+				size := len(keys) / len(ids)
+				if i < len(keys)%len(ids) {
+					size++
+				}
+
+				assignment[id] = append(assignment[id], keys[start:start+size]...)
+				start += size
+			}
+		}
+	}
+
+	return assignment
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sortKeys sorts keys by name, with the partitions of a topic in the order
+// of their numbers.
+func sortKeys(keys []string) {
+	sort.Slice(keys, func(i, j int) bool {
+		nameI, partitionI := splitPartitionKey(keys[i])
+		nameJ, partitionJ := splitPartitionKey(keys[j])
+
+		if nameI != nameJ {
+			return nameI < nameJ
+		}
+
+		return partitionI < partitionJ
+	})
+}
+
+// splitPartitionKey returns the topic and partition of a partition key, or
+// the key itself and -1 for other keys.
+func splitPartitionKey(key string) (string, int) {
+	i := strings.LastIndex(key, "/")
+	if i < 0 {
+		return key, -1
+	}
+
+	partition, err := strconv.Atoi(key[i+1:])
+	if err != nil {
+		return key, -1
+	}
+
+	return key[:i], partition
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+type timestampsMsg struct {
+	Type       string           `json:"type"`
+	Timestamps map[string]int64 `json:"timestamps"`
+	Metadata   bool             `json:"metadata,omitempty"`
+	Forwarded  bool             `json:"forwarded,omitempty"`
+	pollLimits
+}
+
+func (s *server) offsetsForTimesHandler(msg maelstrom.Message) error {
+	var body timestampsMsg
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	var (
+		offsets map[string]int
+		err     error
+	)
+
+	if body.Forwarded {
+		offsets, err = s.localOffsetsForTimes(body.Timestamps)
+	} else {
+		offsets, err = s.offsetsForTimes(body.Timestamps)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return s.n.Reply(msg, map[string]any{
+		"type":    "offsets_for_times_ok",
+		"offsets": offsets,
+	})
+}
+
+// pollByTimeHandler polls every key from its first entry at or after the
+// given timestamp.
+func (s *server) pollByTimeHandler(msg maelstrom.Message) error {
+	var body timestampsMsg
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	offsets, err := s.offsetsForTimes(body.Timestamps)
+	if err != nil {
+		return err
+	}
+
+	msgs, err := s.localMsgs(offsets, body.Metadata, body.pollLimits)
+	if err != nil {
+		return err
+	}
+
+	msgs, nextOffsets, err := limitMsgs(msgs, offsets, body.pollLimits)
+	if err != nil {
+		return err
+	}
+
+	return s.n.Reply(msg, map[string]any{
+		"type":         "poll_by_time_ok",
+		"msgs":         msgs,
+		"next_offsets": nextOffsets,
+	})
+}
+
+// offsetsForTimes asks the leader of every owner for the offsets of its
+// keys concurrently, failing if any of them doesn't have a reachable replica.
+func (s *server) offsetsForTimes(timestamps map[string]int64) (map[string]int, error) {
+	byOwner := make(map[string]map[string]int64)
+	for key, ts := range timestamps {
+		owner := s.ownerOf(key)
+		if byOwner[owner] == nil {
+			byOwner[owner] = make(map[string]int64)
+		}
+
+		byOwner[owner][key] = ts
+	}
+
+	offsets := make(map[string]int, len(timestamps))
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+
+	for owner, timestamps := range byOwner {
+		wg.Add(1)
+		go func(owner string, timestamps map[string]int64) {
+			defer wg.Done()
+
+			ownerOffsets, err := s.ownerOffsetsForTimes(owner, timestamps)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+
+			for key, offset := range ownerOffsets {
+				offsets[key] = offset
+			}
+		}(owner, timestamps)
+	}
+
+	wg.Wait()
+
+	return offsets, firstErr
+}
+
+func (s *server) ownerOffsetsForTimes(owner string, timestamps map[string]int64) (map[string]int, error) {
+	res, err := s.leaderRPC(owner, timestampsMsg{
+		Type:       "offsets_for_times",
+		Timestamps: timestamps,
+		Forwarded:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if res == nil {
+		return s.localOffsetsForTimes(timestamps)
+	}
+
+	var body struct {
+		Offsets map[string]int `json:"offsets"`
+	}
+	if err := json.Unmarshal(res.Body, &body); err != nil {
+		return nil, err
+	}
+
+	return body.Offsets, nil
+}
+
+func (s *server) localOffsetsForTimes(timestamps map[string]int64) (map[string]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	offsets := make(map[string]int, len(timestamps))
+
+	for key, ts := range timestamps {
+		offset, err := s.offsetForTime(ctx, key, ts)
+		if err != nil {
+			return nil, err
+		}
+
+		offsets[key] = offset
+	}
+
+	return offsets, nil
+}
+
+// offsetForTime returns the offset of the first entry of a key with a
+// timestamp at or after ts, or the next offset of the key if there is none
+// yet. The segment index finds the full segment holding it without reading
+// the ones before. Truncated entries are skipped.
+func (s *server) offsetForTime(ctx context.Context, key string, ts int64) (int, error) {
+	start, err := s.logStart(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	kl := s.keyLog(key)
+
+	kl.mu.Lock()
+	if err := s.load(ctx, key, kl); err != nil {
+		kl.mu.Unlock()
+		return 0, err
+	}
+
+	segments, memBase := kl.segments, kl.memBase
+	recent := append([]logEntry(nil), kl.entries...)
+	next := kl.lastOffset() + 1
+	if len(recent) == 0 {
+		next = memBase
+	}
+	kl.mu.Unlock()
+
+	for n, segment := range segments {
+		if segment.Base >= memBase {
+			break
+		}
+
+		if segment.MaxTime < ts {
+			continue
+		}
+
+		entries, err := s.sealedSegment(ctx, key, n)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, entry := range entries {
+			if entry.Offset >= start && entry.Time >= ts {
+				return entry.Offset, nil
+			}
+		}
+	}
+
+	for _, entry := range recent {
+		if entry.Offset >= start && entry.Time >= ts {
+			return entry.Offset, nil
+		}
+	}
+
+	if next < start {
+		return start, nil
+	}
+
+	return next, nil
+}
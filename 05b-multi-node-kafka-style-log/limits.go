@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// This file is kept identical in 05a and 05b, which are separate modules and
+// can't share code, so a change to one copy goes to the other in the same
+// commit.
+
+// pollLimits caps how much a poll returns across all its keys, zero means no
+// limit. A poll returns at least one message even if it's bigger than
+// MaxBytes so consumers always make progress.
+type pollLimits struct {
+	MaxMessages int `json:"max_messages,omitempty"`
+	MaxBytes    int `json:"max_bytes,omitempty"`
+}
+
+// limitMsgs takes one message from every key in turn until the limits are
+// reached, and returns the offset each key should be polled from next.
+func limitMsgs(msgs map[string][]polledMsg, offsets map[string]int, limits pollLimits) (map[string][]polledMsg, map[string]int, error) {
+	keys := make([]string, 0, len(msgs))
+	for key := range msgs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	limited := make(map[string][]polledMsg)
+	count, size := 0, 0
+
+fill:
+	for progress := true; progress; {
+		progress = false
+
+		for _, key := range keys {
+			index := len(limited[key])
+			if index == len(msgs[key]) {
+				continue
+			}
+
+			entry := msgs[key][index]
+			encoded, err := json.Marshal(entry)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if limits.MaxMessages > 0 && count >= limits.MaxMessages ||
+				limits.MaxBytes > 0 && count > 0 && size+len(encoded) > limits.MaxBytes {
+				break fill
+			}
+
+			limited[key] = append(limited[key], entry)
+			count++
+			size += len(encoded)
+			progress = true
+		}
+	}
+
+	nextOffsets := make(map[string]int, len(offsets))
+	for key, offset := range offsets {
+		nextOffsets[key] = offset
+		if entries := limited[key]; len(entries) > 0 {
+			nextOffsets[key] = entries[len(entries)-1].offset + 1
+		}
+	}
+
+	return limited, nextOffsets, nil
+}
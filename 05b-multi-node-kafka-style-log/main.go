@@ -3,7 +3,9 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
+	"sort"
 	"sync"
 	"time"
 
@@ -13,178 +15,506 @@ import (
 const timeout = time.Second
 
 type server struct {
-	n             *maelstrom.Node
-	lKv           *maelstrom.KV
-	sKv           *maelstrom.KV
-	logs          map[string][]logEntry
-	offsets       map[string]int
-	latestOffsets map[string]int
-	mu            sync.RWMutex
+	n       *maelstrom.Node
+	lKv     *maelstrom.KV
+	logs    map[string]*keyLog
+	cache   *segmentCache
+	leaders map[string]string
+	txns    map[string]string
+	txnSeq  int
+	topics  map[string]int
+
+	// consumerGroups holds the groups this node coordinates or did.
+	consumerGroups map[string]*consumerGroup
+	memberSeq      int
+
+	mu sync.RWMutex
 }
 
+// logEntry keeps the producer ID and sequence number of idempotent sends
+// so whichever replica leads the key can deduplicate their retries, and the
+// transaction of entries appended by send_batch. Time is the timestamp of
+// the message in Unix milliseconds.
 type logEntry struct {
-	Offset int `json:"Offset"`
-	Msg    int `json:"Msg"`
+	Offset   int               `json:"Offset"`
+	Msg      json.RawMessage   `json:"Msg"`
+	Headers  map[string]string `json:"Headers,omitempty"`
+	Time     int64             `json:"Time,omitempty"`
+	Producer string            `json:"Producer,omitempty"`
+	Seq      int               `json:"Seq,omitempty"`
+	Txn      string            `json:"Txn,omitempty"`
+}
+
+// keyLog is what the replicas of a key keep in memory: the index of its
+// segments, every entry from memBase onwards and the latest sequence
+// numbers of the producers in those entries. The leader also tracks which
+// followers are in sync and how fast it appends.
+type keyLog struct {
+	loaded    bool
+	segments  []segmentInfo
+	memBase   int
+	entries   []logEntry
+	producers map[string]*producerState
+	isr       map[string]bool
+	appends   rateCounter
+
+	mu sync.Mutex
+}
+
+func (kl *keyLog) add(entry logEntry) {
+	kl.entries = append(kl.entries, entry)
+
+	if entry.Producer == "" {
+		return
+	}
+
+	if kl.producers[entry.Producer] == nil {
+		kl.producers[entry.Producer] = &producerState{}
+	}
+
+	kl.producers[entry.Producer].record(entry.Seq, entry.Offset)
+}
+
+// trim drops the entries before the tail segment from memory once a new
+// segment took over, they stay readable from lin-kv.
+func (kl *keyLog) trim() {
+	if len(kl.segments) == 0 {
+		return
+	}
+
+	base := kl.segments[len(kl.segments)-1].Base
+	if base <= kl.memBase {
+		return
+	}
+
+	kl.entries = append([]logEntry(nil), kl.entries[getOffsetIndex(kl.entries, base):]...)
+	kl.memBase = base
+}
+
+// maxTime returns the latest timestamp of the log up to its last entry.
+func (kl *keyLog) maxTime() int64 {
+	var maxTime int64
+	if n := len(kl.segments); n > 1 {
+		maxTime = kl.segments[n-2].MaxTime
+	}
+
+	for _, entry := range kl.entries {
+		if entry.Time > maxTime {
+			maxTime = entry.Time
+		}
+	}
+
+	return maxTime
+}
+
+func (kl *keyLog) lastOffset() int {
+	if len(kl.entries) == 0 {
+		return -1
+	}
+
+	return kl.entries[len(kl.entries)-1].Offset
 }
 
 func main() {
 	n := maelstrom.NewNode()
 	lKv := maelstrom.NewLinKV(n)
-	sKv := maelstrom.NewSeqKV(n)
 
 	s := &server{
 		n:   n,
 		lKv: lKv,
-		sKv: sKv,
 
-		logs:          make(map[string][]logEntry),
-		offsets:       make(map[string]int),
-		latestOffsets: make(map[string]int),
+		logs:    make(map[string]*keyLog),
+		cache:   newSegmentCache(),
+		leaders: make(map[string]string),
+		txns:    make(map[string]string),
+		topics:  make(map[string]int),
+
+		consumerGroups: make(map[string]*consumerGroup),
 	}
 
+	s.newSessionWorker()
+
+	n.Handle("create_topic", s.createTopicHandler)
 	n.Handle("send", s.sendHandler)
+	n.Handle("send_batch", s.sendBatchHandler)
 	n.Handle("poll", s.pollHandler)
+	n.Handle("offsets_for_times", s.offsetsForTimesHandler)
+	n.Handle("poll_by_time", s.pollByTimeHandler)
 	n.Handle("commit_offsets", s.commitOffsetsHandler)
 	n.Handle("list_committed_offsets", s.listCommitedOffsetsHandler)
+	n.Handle("list_groups", s.listGroupsHandler)
+	n.Handle("delete_group", s.deleteGroupHandler)
+	n.Handle("admin_stats", s.adminStatsHandler)
+	n.Handle("delete_key", s.deleteKeyHandler)
+	n.Handle("truncate_before", s.truncateBeforeHandler)
+	n.Handle("reset_offsets", s.resetOffsetsHandler)
+	n.Handle("join_group", s.joinGroupHandler)
+	n.Handle("heartbeat", s.heartbeatHandler)
+	n.Handle("leave_group", s.leaveGroupHandler)
+	n.Handle("replicate", s.replicateHandler)
 
 	if err := n.Run(); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// sendMsg optionally carries a producer ID and a sequence number that grows
+// with every send of the producer, a retried send with the same sequence
+// number gets the offset originally assigned instead of a new entry.
+// With a topic the key is the key of the message, which picks its partition.
+// The entries of a transaction for the same key are sent together in Msgs
+// instead of Msg.
 type sendMsg struct {
-	Type string `json:"type"`
-	Key  string `json:"key"`
-	Msg  int    `json:"msg"`
+	Type       string            `json:"type"`
+	Key        string            `json:"key"`
+	Msg        json.RawMessage   `json:"msg"`
+	Msgs       []json.RawMessage `json:"msgs,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Timestamp  int64             `json:"timestamp,omitempty"`
+	Topic      string            `json:"topic,omitempty"`
+	ProducerID string            `json:"producer_id,omitempty"`
+	Seq        int               `json:"seq,omitempty"`
+	Txn        string            `json:"txn,omitempty"`
+	Forwarded  bool              `json:"forwarded,omitempty"`
 }
 
+// sendHandler appends to the log of a key on its leader: the first replica
+// reachable from the node that received the send. The leader writes the
+// entry to lin-kv and waits for the in-sync followers before replying.
 func (s *server) sendHandler(msg maelstrom.Message) error {
 	var body sendMsg
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
 		return err
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	ctx, Cancel := context.WithTimeout(context.Background(), timeout)
-	defer Cancel()
-
-	// Get the latest offset for the key
-	offset, err := s.sKv.ReadInt(ctx, body.Key)
+	// Forwarded sends already went through here with their partition key.
+	if body.Topic == "" && !body.Forwarded {
+		if err := checkKey(body.Key); err != nil {
+			return err
+		}
+	}
 
+	payload, err := compactMsg(body.Msg)
 	if err != nil {
-		offset = 0
-	} else {
-		// we should check if the error is from the key not found or generic
-		offset += 1
-	}
-
-	// we could have a local cache and if the latest offset in the cache
-	// is the same we currently have, we don't need to read
-
-	// Get the logs from the store
-
-	// mockLogs := []logEntry{
-	// 	{Offset: 0, Msg: 1},
-	// 	{Offset: 1, Msg: 2},
-	// 	{Offset: 2, Msg: 3},
-	// }
-	//
-	// value, err := json.Marshal(mockLogs)
-	// if err != nil {
-	// 	return err
-	// }
-	//
-	// err = s.lKv.Write(ctx, "test", string(value))
-	//
-	// if err != nil {
-	// 	return err
-	// }
-
-	logs, err := s.lKv.Read(context.Background(), body.Key)
-	if err != nil {
-		// When trying to read before writing, we get an error
-		log.Printf("err: %v", err)
-		logs = `[]`
+		return err
+	}
+	body.Msg = payload
+
+	res := map[string]any{
+		"type": "send_ok",
 	}
 
-	var logEntries []logEntry
-	if logsStr, ok := logs.(string); ok {
-		logsData := []byte(logsStr)
-		if err := json.Unmarshal(logsData, &logEntries); err != nil {
+	if body.Topic != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		partitions, err := s.topicPartitions(ctx, body.Topic)
+		cancel()
+
+		if err != nil {
 			return err
 		}
-	}
 
-	logEntries = append(logEntries, logEntry{
-		Offset: offset,
-		Msg:    body.Msg,
-	})
+		partition := partitionFor(body.Key, partitions)
+		body.Key, body.Topic = partitionKey(body.Topic, partition), ""
+		res["partition"] = partition
+	}
 
-	entries, err := json.Marshal(logEntries)
+	offsets, err := s.send(body)
 	if err != nil {
 		return err
 	}
 
-	err = s.lKv.Write(ctx, body.Key, string(entries))
+	res["offset"] = offsets[0]
+	if len(body.Msgs) > 0 {
+		res["offsets"] = offsets
+	}
+
+	return s.n.Reply(msg, res)
+}
+
+// send forwards a send to the leader of its key, or appends it locally if
+// this node is the leader or the send was already forwarded. It returns the
+// offset of every message it appended.
+func (s *server) send(body sendMsg) ([]int, error) {
+	owner := s.ownerOf(body.Key)
+
+	if !body.Forwarded {
+		body.Forwarded = true
+
+		res, err := s.leaderRPC(owner, body)
+		if err != nil {
+			return nil, err
+		}
+
+		if res != nil {
+			var resBody struct {
+				Offset  int   `json:"offset"`
+				Offsets []int `json:"offsets"`
+			}
+			if err := json.Unmarshal(res.Body, &resBody); err != nil {
+				return nil, err
+			}
+
+			if resBody.Offsets != nil {
+				return resBody.Offsets, nil
+			}
+
+			return []int{resBody.Offset}, nil
+		}
+	}
+
+	// Only the compare-and-swaps of the segments fail with PreconditionFailed,
+	// producer rejections have their own code.
+	offsets, err := s.appendLocal(body)
+	if maelstrom.ErrorCode(err) == maelstrom.PreconditionFailed {
+		s.clearLeader(owner)
+		return nil, maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable,
+			fmt.Sprintf("another replica appended to %s, retry", body.Key))
+	}
+
+	return offsets, err
+}
+
+// appendLocal appends to the log of a key as its leader, sends for the same
+// key are serialized so the tail segment is written in order. The messages
+// of a batch get consecutive offsets and are written and replicated together.
+func (s *server) appendLocal(body sendMsg) ([]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	kl := s.keyLog(body.Key)
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+
+	if err := s.load(ctx, body.Key, kl); err != nil {
+		return nil, err
+	}
 
+	if body.ProducerID != "" {
+		offset, found, err := kl.producers[body.ProducerID].lookup(body.ProducerID, body.Seq)
+		if err != nil {
+			return nil, err
+		}
+
+		if found {
+			return []int{offset}, nil
+		}
+	}
+
+	msgs := body.Msgs
+	if len(msgs) == 0 {
+		msgs = []json.RawMessage{body.Msg}
+	}
+
+	first, err := s.allocateOffsets(ctx, body.Key, len(msgs))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return s.n.Reply(msg, map[string]any{
-		"type":   "send_ok",
-		"offset": offset,
-	})
+	if body.Timestamp == 0 {
+		body.Timestamp = time.Now().UnixMilli()
+	}
+
+	entries := make([]logEntry, len(msgs))
+	offsets := make([]int, len(msgs))
+
+	for i, msg := range msgs {
+		entries[i] = logEntry{
+			Offset:   first + i,
+			Msg:      msg,
+			Headers:  body.Headers,
+			Time:     body.Timestamp,
+			Producer: body.ProducerID,
+			Seq:      body.Seq,
+			Txn:      body.Txn,
+		}
+		offsets[i] = first + i
+	}
+	prev := kl.lastOffset()
+
+	if err := s.appendEntries(ctx, body.Key, kl, entries); err != nil {
+		// Our copy of the log is stale, reload it on the next send.
+		kl.loaded = false
+		return nil, err
+	}
+
+	now := time.Now()
+	for range entries {
+		kl.appends.add(now)
+	}
+
+	if err := s.replicate(body.Key, kl, entries, prev); err != nil {
+		return nil, err
+	}
+
+	return offsets, nil
 }
 
+func (s *server) keyLog(key string) *keyLog {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kl, ok := s.logs[key]
+	if !ok {
+		kl = &keyLog{}
+		s.logs[key] = kl
+	}
+
+	return kl
+}
+
+// allocateOffsets reserves the next n offsets for a key by moving its latest
+// offset register forward with a compare-and-swap, retrying whenever another
+// node moved it first. It returns the first offset reserved.
+func (s *server) allocateOffsets(ctx context.Context, key string, n int) (int, error) {
+	for {
+		latest, err := s.lKv.ReadInt(ctx, offsetKey(key))
+		if err != nil {
+			if maelstrom.ErrorCode(err) != maelstrom.KeyDoesNotExist {
+				return 0, err
+			}
+
+			latest = -1
+		}
+
+		err = s.lKv.CompareAndSwap(ctx, offsetKey(key), latest, latest+n, true)
+		if err == nil {
+			return latest + 1, nil
+		}
+
+		if maelstrom.ErrorCode(err) != maelstrom.PreconditionFailed {
+			return 0, err
+		}
+	}
+}
+
+func offsetKey(key string) string {
+	return metaKey(key, "offset")
+}
+
+// metaKey names a register of a key in lin-kv. The registers of every key
+// live under a prefix no key can produce, with the length of the key in
+// front of it, so a key like a/segments never collides with the registers
+// of the key a.
+func metaKey(key, register string) string {
+	return fmt.Sprintf("\x00meta/%d:%s/%s", len(key), key, register)
+}
+
+// offsetsMsg lists the topics a poll subscribes to next to the offsets of
+// its keys, with Metadata the poll also returns the headers and timestamp of
+// every message.
 type offsetsMsg struct {
-	Offsets map[string]int `json:"offsets"`
-	Type    string         `json:"type"`
+	Offsets  map[string]int `json:"offsets"`
+	Type     string         `json:"type"`
+	Group    string         `json:"group,omitempty"`
+	Topics   []string       `json:"topics,omitempty"`
+	Metadata bool           `json:"metadata,omitempty"`
+	pollLimits
 }
 
+// pollHandler reads the keys from lin-kv through the segment cache, so any
+// node can answer a poll without asking the leaders of its keys.
 func (s *server) pollHandler(msg maelstrom.Message) error {
 	var body offsetsMsg
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
 		return err
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	msgs := make(map[string][][]int)
+	offsets, err := s.subscribe(body.Offsets, body.Topics)
+	if err != nil {
+		return err
+	}
 
-	for key, offset := range body.Offsets {
-		logs := s.logs[key]
-		index := getOffsetIndex(logs, offset)
+	msgs, err := s.localMsgs(offsets, body.Metadata, body.pollLimits)
+	if err != nil {
+		return err
+	}
 
-		for ; index < len(logs); index++ {
-			entries := logs[index]
-			intEntry := []int{entries.Offset, entries.Msg}
-			msgs[key] = append(msgs[key], intEntry)
-		}
+	msgs, nextOffsets, err := limitMsgs(msgs, offsets, body.pollLimits)
+	if err != nil {
+		return err
 	}
 
 	res := map[string]any{
-		"type": "poll_ok",
-		"msgs": msgs,
+		"type":         "poll_ok",
+		"msgs":         msgs,
+		"next_offsets": nextOffsets,
 	}
 
 	return s.n.Reply(msg, res)
 }
 
+// localMsgs reads the keys through this node's segment cache, up to what a
+// poll with limits can return from each of them. Entries of aborted
+// transactions are skipped and a key is only read up to its first entry of
+// a pending transaction, so transactions become visible at once.
+// Every key is read before any transaction is resolved, and each one is
+// resolved once per poll, so all keys agree on whether it committed.
+func (s *server) localMsgs(offsets map[string]int, metadata bool, limits pollLimits) (map[string][]polledMsg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	logs := make(map[string][]logEntry, len(offsets))
+	for key, offset := range offsets {
+		entries, err := s.cachedLog(ctx, key, offset, limits)
+		if err != nil {
+			return nil, err
+		}
+
+		logs[key] = entries
+	}
+
+	statuses := make(map[string]string)
+	msgs := make(map[string][]polledMsg)
+
+	for key, entries := range logs {
+	entries:
+		for _, entry := range entries {
+			if entry.Txn != "" {
+				status, ok := statuses[entry.Txn]
+				if !ok {
+					var err error
+					if status, err = s.txnStatus(ctx, entry.Txn); err != nil {
+						return nil, err
+					}
+
+					statuses[entry.Txn] = status
+				}
+
+				switch status {
+				case txnAborted:
+					continue
+				case txnPending:
+					break entries
+				}
+			}
+
+			msgs[key] = append(msgs[key], entry.polled(metadata))
+		}
+	}
+
+	return msgs, nil
+}
+
+// commitOffsetsHandler stores the committed offsets in lin-kv so they can
+// be listed from any node, committing for a group creates it.
 func (s *server) commitOffsetsHandler(msg maelstrom.Message) error {
 	var body offsetsMsg
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
 		return err
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	generation, err := s.groupGeneration(ctx, body.Group, true)
+	if err != nil {
+		return err
+	}
 
 	for k, v := range body.Offsets {
-		s.offsets[k] = v
+		if err := s.commitOffset(ctx, committedKey(k, body.Group, generation), v); err != nil {
+			return err
+		}
 	}
 
 	res := map[string]any{
@@ -194,36 +524,100 @@ func (s *server) commitOffsetsHandler(msg maelstrom.Message) error {
 	return s.n.Reply(msg, res)
 }
 
+type listCommittedOffsetsMsg struct {
+	Type  string   `json:"type"`
+	Keys  []string `json:"keys"`
+	Group string   `json:"group,omitempty"`
+}
+
 func (s *server) listCommitedOffsetsHandler(msg maelstrom.Message) error {
-	var body map[string]any
+	var body listCommittedOffsetsMsg
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
 		return err
 	}
 
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Generations start at 1, so nothing is ever committed for a group
+	// that doesn't exist.
+	generation, err := s.groupGeneration(ctx, body.Group, false)
+	if err != nil {
+		return err
+	}
+
+	offsets := make(map[string]int)
+
+	for _, key := range body.Keys {
+		offset, exists, err := s.committedOffset(ctx, committedKey(key, body.Group, generation))
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			offsets[key] = offset
+		}
+	}
 
 	res := map[string]any{
 		"type":    "list_committed_offsets_ok",
-		"offsets": s.offsets,
+		"offsets": offsets,
 	}
 
 	return s.n.Reply(msg, res)
 }
 
-// TODO: This is not efficient we should use a binary search
-func (s *server) offsetIndex(logs []logEntry, offset int) int {
-	log.Printf("offsetIndex logs: %v", logs)
-	for i := range logs {
-		log.Printf("offsetIndex offset: %v", offset)
-		log.Printf("offsetIndex logs: %v", logs[i])
-		if logs[i].Offset == offset {
-			log.Printf("found i: %v", i)
-			return i
+func (s *server) listGroupsHandler(msg maelstrom.Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	groups, err := s.groups(ctx)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(groups))
+	for group, generation := range groups {
+		if generation > 0 {
+			names = append(names, group)
 		}
 	}
 
-	return 0
+	sort.Strings(names)
+
+	return s.n.Reply(msg, map[string]any{
+		"type":   "list_groups_ok",
+		"groups": names,
+	})
+}
+
+type groupMsg struct {
+	Type  string `json:"type"`
+	Group string `json:"group"`
+}
+
+func (s *server) deleteGroupHandler(msg maelstrom.Message) error {
+	var body groupMsg
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	deleted, err := s.deleteGroup(ctx, body.Group)
+	if err != nil {
+		return err
+	}
+
+	if !deleted {
+		return maelstrom.NewRPCError(maelstrom.KeyDoesNotExist,
+			fmt.Sprintf("group %q does not exist", body.Group))
+	}
+
+	return s.n.Reply(msg, map[string]any{
+		"type": "delete_group_ok",
+	})
 }
 
 func getOffsetIndex(entries []logEntry, startingOffset int) int {
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// groupsKey holds the generation of every consumer group as a JSON object.
+// Deleting a group negates its generation, so a group created again with the
+// same name gets a new generation and doesn't see the old offsets.
+const groupsKey = "groups"
+
+// committedKey returns where the committed offset of a key is stored for a
+// consumer group, the default group has an empty name and no generation.
+func committedKey(key, group string, generation int) string {
+	if group == "" {
+		return metaKey(key, "committed")
+	}
+
+	return metaKey(key, fmt.Sprintf("committed/%d:%s/%d", len(group), group, generation))
+}
+
+// commitOffset moves a committed offset forward with a compare-and-swap,
+// committing an older offset than the current one is a no-op so offsets
+// never move backwards. It fails with TemporarilyUnavailable while a
+// transaction that commits the same offset is pending.
+func (s *server) commitOffset(ctx context.Context, ckey string, offset int) error {
+	for {
+		current, err := s.readCommitted(ctx, ckey)
+		if err != nil {
+			return err
+		}
+
+		if current.pending != "" {
+			return maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable,
+				fmt.Sprintf("%s is being committed by transaction %s", ckey, current.pending))
+		}
+
+		if current.exists && current.offset >= offset {
+			return nil
+		}
+
+		err = s.lKv.CompareAndSwap(ctx, ckey, current.value, offset, true)
+		if err == nil {
+			return nil
+		}
+
+		if maelstrom.ErrorCode(err) != maelstrom.PreconditionFailed {
+			return err
+		}
+	}
+}
+
+// resetCommitted sets a committed offset with a compare-and-swap, even
+// backwards. Like commitOffset it fails with TemporarilyUnavailable while a
+// transaction that commits the same offset is pending, which would
+// otherwise overwrite the reset when it finishes.
+func (s *server) resetCommitted(ctx context.Context, ckey string, offset int) error {
+	for {
+		current, err := s.readCommitted(ctx, ckey)
+		if err != nil {
+			return err
+		}
+
+		if current.pending != "" {
+			return maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable,
+				fmt.Sprintf("%s is being committed by transaction %s", ckey, current.pending))
+		}
+
+		err = s.lKv.CompareAndSwap(ctx, ckey, current.value, offset, true)
+		if err == nil {
+			return nil
+		}
+
+		if maelstrom.ErrorCode(err) != maelstrom.PreconditionFailed {
+			return err
+		}
+	}
+}
+
+// committedOffset returns a committed offset, and false if nothing was
+// committed yet.
+func (s *server) committedOffset(ctx context.Context, ckey string) (int, bool, error) {
+	current, err := s.readCommitted(ctx, ckey)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return current.offset, current.exists, nil
+}
+
+// An offset committed in a transaction is stored as the marker
+// txn:<id>:<offset>:<previous offset>, which reads as the offset once the
+// transaction commits and as the previous one, or as nothing committed if
+// it's empty, until then. Markers are never rewritten once their transaction
+// finishes, reading them again only costs the cached transaction status.
+const txnMarkerPrefix = "txn:"
+
+func txnMarker(txn string, offset int, previous committedValue) string {
+	marker := fmt.Sprintf("%s%s:%d:", txnMarkerPrefix, txn, offset)
+	if previous.exists {
+		marker += strconv.Itoa(previous.offset)
+	}
+
+	return marker
+}
+
+// committedValue is the value of a committed offset register. Pending is the
+// transaction of the marker it holds while that one is still pending.
+type committedValue struct {
+	value   any
+	offset  int
+	exists  bool
+	pending string
+}
+
+// readCommitted reads a committed offset register, resolving transaction
+// markers through the status of their transaction.
+func (s *server) readCommitted(ctx context.Context, ckey string) (committedValue, error) {
+	value, err := s.lKv.Read(ctx, ckey)
+	if err != nil {
+		if maelstrom.ErrorCode(err) == maelstrom.KeyDoesNotExist {
+			return committedValue{}, nil
+		}
+
+		return committedValue{}, err
+	}
+
+	switch v := value.(type) {
+	case int:
+		return committedValue{value: value, offset: v, exists: true}, nil
+
+	case string:
+		fields := strings.Split(strings.TrimPrefix(v, txnMarkerPrefix), ":")
+		if !strings.HasPrefix(v, txnMarkerPrefix) || len(fields) != 3 {
+			break
+		}
+
+		status, err := s.txnStatus(ctx, fields[0])
+		if err != nil {
+			return committedValue{}, err
+		}
+
+		c := committedValue{value: value}
+		if status == txnPending {
+			c.pending = fields[0]
+		}
+
+		resolved := fields[2]
+		if status == txnCommitted {
+			resolved = fields[1]
+		}
+
+		if resolved != "" {
+			if c.offset, err = strconv.Atoi(resolved); err != nil {
+				return committedValue{}, err
+			}
+			c.exists = true
+		}
+
+		return c, nil
+	}
+
+	return committedValue{}, fmt.Errorf("unexpected committed offset for %s: %v", ckey, value)
+}
+
+func (s *server) groups(ctx context.Context) (map[string]int, error) {
+	groups := make(map[string]int)
+	if _, err := s.readJSON(ctx, groupsKey, &groups); err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+// groupGeneration returns the generation of a group, or 0 if it doesn't
+// exist. With create set a missing or deleted group is created.
+func (s *server) groupGeneration(ctx context.Context, group string, create bool) (int, error) {
+	if group == "" {
+		return 0, nil
+	}
+
+	for {
+		groups, err := s.groups(ctx)
+		if err != nil {
+			return 0, err
+		}
+
+		generation := groups[group]
+		if generation > 0 {
+			return generation, nil
+		}
+
+		if !create {
+			return 0, nil
+		}
+
+		next := make(map[string]int, len(groups)+1)
+		for g, gen := range groups {
+			next[g] = gen
+		}
+		next[group] = -generation + 1
+
+		err = s.casJSON(ctx, groupsKey, groups, next)
+		if err == nil {
+			return next[group], nil
+		}
+
+		if maelstrom.ErrorCode(err) != maelstrom.PreconditionFailed {
+			return 0, err
+		}
+	}
+}
+
+// deleteGroup negates the generation of a group, it returns false if the
+// group doesn't exist.
+func (s *server) deleteGroup(ctx context.Context, group string) (bool, error) {
+	for {
+		groups, err := s.groups(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		generation := groups[group]
+		if generation <= 0 {
+			return false, nil
+		}
+
+		next := make(map[string]int, len(groups))
+		for g, gen := range groups {
+			next[g] = gen
+		}
+		next[group] = -generation
+
+		err = s.casJSON(ctx, groupsKey, groups, next)
+		if err == nil {
+			return true, nil
+		}
+
+		if maelstrom.ErrorCode(err) != maelstrom.PreconditionFailed {
+			return false, err
+		}
+	}
+}
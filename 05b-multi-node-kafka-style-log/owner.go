@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+const replicationFactor = 3
+
+// forwardTimeout leaves the leader enough time to write to lin-kv and wait
+// for its followers before we give up on it.
+const forwardTimeout = 2 * timeout
+
+// ownerOf hashes a key to the node that owns its log, every node sorts the
+// cluster the same way so they all agree on the owner.
+func (s *server) ownerOf(key string) string {
+	nodeIDs := s.sortedNodeIDs()
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return nodeIDs[h.Sum32()%uint32(len(nodeIDs))]
+}
+
+// replicasOf returns the owner followed by the nodes after it in the ring.
+// The owner leads the keys it owns and the next replica takes over when
+// the ones before it are unreachable.
+func (s *server) replicasOf(owner string) []string {
+	nodeIDs := s.sortedNodeIDs()
+	start := sort.SearchStrings(nodeIDs, owner)
+
+	count := replicationFactor
+	if count > len(nodeIDs) {
+		count = len(nodeIDs)
+	}
+
+	replicas := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		replicas = append(replicas, nodeIDs[(start+i)%len(nodeIDs)])
+	}
+
+	return replicas
+}
+
+// followers returns the replicas of a key other than this node.
+func (s *server) followers(key string) []string {
+	var followers []string
+	for _, replica := range s.replicasOf(s.ownerOf(key)) {
+		if replica != s.n.ID() {
+			followers = append(followers, replica)
+		}
+	}
+
+	return followers
+}
+
+func (s *server) sortedNodeIDs() []string {
+	nodeIDs := append([]string(nil), s.n.NodeIDs()...)
+	sort.Strings(nodeIDs)
+
+	return nodeIDs
+}
+
+// leaderRPC sends a request to the leader of owner, the last replica that
+// answered or the first one in the ring. It returns a nil message when this
+// node is the leader and should handle the request itself.
+//
+// A leader that doesn't answer in time may still handle the request, so it
+// isn't sent to another replica, which could handle it a second time.
+// Instead the request fails with Crash, as it may or may not have happened,
+// and the next one goes to the next replica, so an unreachable leader is
+// replaced as soon as the client retries.
+func (s *server) leaderRPC(owner string, body any) (*maelstrom.Message, error) {
+	candidates := s.candidates(owner)
+
+	leader := candidates[0]
+	if leader == s.n.ID() {
+		s.setLeader(owner, leader)
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+	res, err := s.n.SyncRPC(ctx, leader, body)
+	cancel()
+
+	var rpcErr *maelstrom.RPCError
+	if err != nil && !errors.As(err, &rpcErr) {
+		log.Printf("leader %s of %s unreachable: %v", leader, owner, err)
+		s.setLeader(owner, candidates[1%len(candidates)])
+
+		return nil, maelstrom.NewRPCError(maelstrom.Crash,
+			fmt.Sprintf("leader %s of %s didn't answer, it may have handled the request", leader, owner))
+	}
+
+	s.setLeader(owner, leader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+// candidates returns the replicas of owner in the order they should be
+// tried, the last known leader goes first.
+func (s *server) candidates(owner string) []string {
+	replicas := s.replicasOf(owner)
+
+	s.mu.RLock()
+	leader, ok := s.leaders[owner]
+	s.mu.RUnlock()
+
+	if !ok {
+		return replicas
+	}
+
+	candidates := []string{leader}
+	for _, replica := range replicas {
+		if replica != leader {
+			candidates = append(candidates, replica)
+		}
+	}
+
+	return candidates
+}
+
+func (s *server) setLeader(owner, leader string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.leaders[owner] = leader
+}
+
+// clearLeader forgets the leader of owner so the next request goes through
+// the replicas in order again.
+func (s *server) clearLeader(owner string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.leaders, owner)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+const (
+	replicationTimeout = 500 * time.Millisecond
+
+	// minInSyncReplicas is a majority of the replicas and counts the leader,
+	// a send fails if fewer replicas acknowledged it.
+	minInSyncReplicas = replicationFactor/2 + 1
+)
+
+type replicateMsg struct {
+	Type     string        `json:"type"`
+	Key      string        `json:"key"`
+	Entries  []logEntry    `json:"entries"`
+	Prev     int           `json:"prev"`
+	Segments []segmentInfo `json:"segments"`
+}
+
+// replicate sends new entries to the followers of a key and waits for the
+// in-sync ones to acknowledge them. Followers that don't answer in time leave
+// the in-sync set and rejoin it the next time they acknowledge an entry,
+// which the leader also waits for when too few replicas are in sync.
+// The send fails with Crash if fewer than a majority of the replicas have
+// the entries, since they are already in lin-kv and polls may return them.
+// The caller must hold kl.mu.
+func (s *server) replicate(key string, kl *keyLog, entries []logEntry, prev int) error {
+	followers := s.followers(key)
+
+	if kl.isr == nil {
+		kl.isr = make(map[string]bool, len(followers))
+		for _, follower := range followers {
+			kl.isr[follower] = true
+		}
+	}
+
+	// Clusters smaller than the replication factor need all their nodes.
+	required := minInSyncReplicas
+	if required > len(followers)+1 {
+		required = len(followers) + 1
+	}
+
+	req := replicateMsg{
+		Type:     "replicate",
+		Key:      key,
+		Entries:  entries,
+		Prev:     prev,
+		Segments: kl.segments,
+	}
+
+	type ack struct {
+		follower string
+		err      error
+	}
+
+	inSync := make(chan ack, len(followers))
+	outOfSync := make(chan ack, len(followers))
+	waiting, lagging := 0, 0
+
+	for _, follower := range followers {
+		acks := outOfSync
+		if kl.isr[follower] {
+			acks = inSync
+			waiting++
+		} else {
+			lagging++
+		}
+
+		go func(follower string, acks chan<- ack) {
+			ctx, cancel := context.WithTimeout(context.Background(), replicationTimeout)
+			defer cancel()
+
+			_, err := s.n.SyncRPC(ctx, follower, req)
+			acks <- ack{follower: follower, err: err}
+		}(follower, acks)
+	}
+
+	for ; waiting > 0; waiting-- {
+		a := <-inSync
+		if a.err != nil {
+			log.Printf("follower %s of %s out of sync: %v", a.follower, key, a.err)
+			delete(kl.isr, a.follower)
+		}
+	}
+
+	for ; lagging > 0 && len(kl.isr)+1 < required; lagging-- {
+		if a := <-outOfSync; a.err == nil {
+			kl.isr[a.follower] = true
+		}
+	}
+
+	// The followers left catch up in the background.
+	go func(lagging int) {
+		for ; lagging > 0; lagging-- {
+			if a := <-outOfSync; a.err == nil {
+				kl.mu.Lock()
+				kl.isr[a.follower] = true
+				kl.mu.Unlock()
+			}
+		}
+	}(lagging)
+
+	if len(kl.isr)+1 < required {
+		return maelstrom.NewRPCError(maelstrom.Crash,
+			fmt.Sprintf("only %d of the %d replicas of %s needed are in sync", len(kl.isr)+1, required, key))
+	}
+
+	return nil
+}
+
+// replicateHandler adds entries from the leader to the log in memory.
+// If the follower missed some entries it reloads the tail from lin-kv,
+// which the leader writes before replicating.
+func (s *server) replicateHandler(msg maelstrom.Message) error {
+	var body replicateMsg
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	kl := s.keyLog(body.Key)
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+
+	if err := s.load(ctx, body.Key, kl); err != nil {
+		return err
+	}
+
+	last := kl.lastOffset()
+
+	switch {
+	case body.Entries[len(body.Entries)-1].Offset <= last:
+		// Already loaded from lin-kv.
+	case body.Prev == last:
+		kl.segments = body.Segments
+		for _, entry := range body.Entries {
+			kl.add(entry)
+		}
+		kl.trim()
+	default:
+		kl.loaded = false
+		if err := s.load(ctx, body.Key, kl); err != nil {
+			return err
+		}
+	}
+
+	return s.n.Reply(msg, map[string]any{
+		"type": "replicate_ok",
+	})
+}
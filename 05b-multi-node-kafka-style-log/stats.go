@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// Append rates are averaged over the last rateBuckets seconds.
+const rateBuckets = 10
+
+// rateCounter counts events in one second buckets.
+type rateCounter struct {
+	buckets [rateBuckets]int
+	last    int64
+}
+
+func (c *rateCounter) add(now time.Time) {
+	c.advance(now.Unix())
+	c.buckets[now.Unix()%rateBuckets]++
+}
+
+// rate returns the events per second over the last rateBuckets seconds.
+func (c *rateCounter) rate(now time.Time) float64 {
+	c.advance(now.Unix())
+
+	total := 0
+	for _, count := range c.buckets {
+		total += count
+	}
+
+	return float64(total) / rateBuckets
+}
+
+// advance clears the buckets of the seconds that passed since the last
+// event.
+func (c *rateCounter) advance(second int64) {
+	if second <= c.last {
+		return
+	}
+
+	if second-c.last >= rateBuckets {
+		c.buckets = [rateBuckets]int{}
+	} else {
+		for s := c.last + 1; s <= second; s++ {
+			c.buckets[s%rateBuckets] = 0
+		}
+	}
+
+	c.last = second
+}
+
+// keyStats describes a key for operators. The high watermark is the offset
+// the next message gets, and the lag of a group is how many messages come
+// after the offset it committed. The default group has an empty name.
+// The append rate is only known by the nodes that led the key recently.
+type keyStats struct {
+	HighWatermark int            `json:"high_watermark"`
+	LogStart      int            `json:"log_start"`
+	Size          int            `json:"size"`
+	AppendRate    float64        `json:"append_rate"`
+	Committed     map[string]int `json:"committed"`
+	Lag           map[string]int `json:"lag"`
+}
+
+type adminStatsMsg struct {
+	Type  string   `json:"type"`
+	Keys  []string `json:"keys,omitempty"`
+	Scope string   `json:"scope,omitempty"`
+}
+
+// adminStatsHandler returns the stats of the requested keys, or of every key
+// this node holds a replica of without any. With the cluster scope it asks
+// every other node too and merges their stats, adding up the append rates.
+func (s *server) adminStatsHandler(msg maelstrom.Message) error {
+	var body adminStatsMsg
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	stats, err := s.nodeStats(body.Keys)
+	if err != nil {
+		return err
+	}
+
+	res := map[string]any{
+		"type": "admin_stats_ok",
+		"keys": stats,
+	}
+
+	if body.Scope == "cluster" {
+		res["unreachable"] = s.clusterStats(body.Keys, stats)
+	}
+
+	return s.n.Reply(msg, res)
+}
+
+func (s *server) nodeStats(keys []string) (map[string]keyStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if len(keys) == 0 {
+		s.mu.RLock()
+		for key := range s.logs {
+			keys = append(keys, key)
+		}
+		s.mu.RUnlock()
+	}
+
+	groups, err := s.groups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	groups[""] = 0
+
+	now := time.Now()
+	stats := make(map[string]keyStats, len(keys))
+
+	for _, key := range keys {
+		latest, err := s.latestOffset(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		start, err := s.logStart(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		s.mu.RLock()
+		kl := s.logs[key]
+		s.mu.RUnlock()
+
+		rate := 0.0
+		if kl != nil {
+			kl.mu.Lock()
+			rate = kl.appends.rate(now)
+			kl.mu.Unlock()
+		}
+
+		st := keyStats{
+			HighWatermark: latest + 1,
+			LogStart:      start,
+			Size:          latest + 1 - start,
+			AppendRate:    rate,
+			Committed:     make(map[string]int),
+			Lag:           make(map[string]int),
+		}
+
+		for group, generation := range groups {
+			if generation < 0 {
+				continue
+			}
+
+			committed, ok, err := s.committedOffset(ctx, committedKey(key, group, generation))
+			if err != nil {
+				return nil, err
+			}
+
+			if !ok {
+				continue
+			}
+
+			st.Committed[group] = committed
+			st.Lag[group] = 0
+			if lag := latest - committed; lag > 0 {
+				st.Lag[group] = lag
+			}
+		}
+
+		stats[key] = st
+	}
+
+	return stats, nil
+}
+
+// clusterStats merges the stats of every other node into stats and returns
+// the nodes that didn't answer.
+func (s *server) clusterStats(keys []string, stats map[string]keyStats) []string {
+	var (
+		wg          sync.WaitGroup
+		mu          sync.Mutex
+		unreachable = []string{}
+	)
+
+	for _, node := range s.n.NodeIDs() {
+		if node == s.n.ID() {
+			continue
+		}
+
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+			defer cancel()
+
+			res, err := s.n.SyncRPC(ctx, node, adminStatsMsg{Type: "admin_stats", Keys: keys})
+
+			var body struct {
+				Keys map[string]keyStats `json:"keys"`
+			}
+			if err == nil {
+				err = json.Unmarshal(res.Body, &body)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				log.Printf("admin_stats from %s: %v", node, err)
+				unreachable = append(unreachable, node)
+				return
+			}
+
+			for key, st := range body.Keys {
+				merged, ok := stats[key]
+				if !ok || st.HighWatermark > merged.HighWatermark {
+					st.AppendRate += merged.AppendRate
+					stats[key] = st
+					continue
+				}
+
+				merged.AppendRate += st.AppendRate
+				stats[key] = merged
+			}
+		}(node)
+	}
+
+	wg.Wait()
+
+	return unreachable
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// Logs are stored in lin-kv as segments of up to segmentSize entries under
+// <key>/segment/<n>, with the base offset of every segment in the index at
+// <key>/segments. Appends only rewrite the tail segment and reads only fetch
+// the segments holding the offsets they need.
+const segmentSize = 100
+
+// segmentInfo is an entry of the segment index. Once a segment is full it
+// also keeps the latest timestamp of the log up to its last entry, so the
+// timestamps in the index never go backwards even if the clock does.
+// The tail segment keeps the sequence numbers of the producers up to its
+// base, so loading only the tail still deduplicates retries of older sends.
+type segmentInfo struct {
+	Base      int                      `json:"Base"`
+	MaxTime   int64                    `json:"MaxTime,omitempty"`
+	Producers map[string][]producerSeq `json:"Producers,omitempty"`
+}
+
+func segmentKey(key string, n int) string {
+	return metaKey(key, fmt.Sprintf("segment/%d", n))
+}
+
+func segmentsKey(key string) string {
+	return metaKey(key, "segments")
+}
+
+// load reads the segment index and the tail segment of a key the first time
+// the owner needs its log, older segments stay in lin-kv.
+// The caller must hold kl.mu.
+func (s *server) load(ctx context.Context, key string, kl *keyLog) error {
+	if kl.loaded {
+		return nil
+	}
+
+	var segments []segmentInfo
+	if _, err := s.readJSON(ctx, segmentsKey(key), &segments); err != nil {
+		return err
+	}
+
+	var entries []logEntry
+	memBase := 0
+
+	if len(segments) > 0 {
+		memBase = segments[len(segments)-1].Base
+		if _, err := s.readJSON(ctx, segmentKey(key, len(segments)-1), &entries); err != nil {
+			return err
+		}
+	}
+
+	kl.loaded = true
+	kl.segments = segments
+	kl.memBase = memBase
+	kl.entries = nil
+	kl.producers = make(map[string]*producerState)
+
+	if len(segments) > 0 {
+		for producer, recent := range segments[len(segments)-1].Producers {
+			kl.producers[producer] = &producerState{recent: recent}
+		}
+	}
+
+	for _, entry := range entries {
+		kl.add(entry)
+	}
+
+	return nil
+}
+
+// appendEntries writes entries to the tail segment of a key, filling it up
+// before starting new segments, and then adds them to the log in memory,
+// which only keeps the entries of the tail segment.
+// Every segment is written with a single compare-and-swap from what this
+// node has in memory, so it fails with PreconditionFailed if another replica
+// appended in the meantime. A batch spanning several segments that already
+// wrote some of them fails with Crash instead, since part of it is in the log.
+// The caller must hold kl.mu.
+func (s *server) appendEntries(ctx context.Context, key string, kl *keyLog, entries []logEntry) error {
+	total := len(entries)
+	failed := func(err error) error {
+		if len(entries) < total && maelstrom.ErrorCode(err) == maelstrom.PreconditionFailed {
+			return maelstrom.NewRPCError(maelstrom.Crash,
+				fmt.Sprintf("appended %d of %d entries to %s before another replica did", total-len(entries), total, key))
+		}
+
+		return err
+	}
+
+	for len(entries) > 0 {
+		if len(kl.segments) > 0 {
+			tail := kl.entries[getOffsetIndex(kl.entries, kl.segments[len(kl.segments)-1].Base):]
+
+			if room := segmentSize - len(tail); room > 0 {
+				if room > len(entries) {
+					room = len(entries)
+				}
+
+				segment := append(append([]logEntry(nil), tail...), entries[:room]...)
+				if err := s.casJSON(ctx, segmentKey(key, len(kl.segments)-1), tail, segment); err != nil {
+					return failed(err)
+				}
+
+				for _, entry := range entries[:room] {
+					kl.add(entry)
+				}
+
+				entries = entries[room:]
+				continue
+			}
+		}
+
+		// Claim the new segment in the index first, a segment missing from
+		// lin-kv reads as empty. The full tail gets its latest timestamp at the
+		// same time and hands its producers over to the new one.
+		segments := append([]segmentInfo(nil), kl.segments...)
+		if len(segments) > 0 {
+			segments[len(segments)-1].MaxTime = kl.maxTime()
+			segments[len(segments)-1].Producers = nil
+		}
+		segments = append(segments, segmentInfo{
+			Base:      entries[0].Offset,
+			Producers: producerSnapshot(kl.producers),
+		})
+
+		if err := s.casJSON(ctx, segmentsKey(key), kl.segments, segments); err != nil {
+			return failed(err)
+		}
+
+		size := segmentSize
+		if size > len(entries) {
+			size = len(entries)
+		}
+
+		if err := s.casJSON(ctx, segmentKey(key, len(kl.segments)), nil, entries[:size]); err != nil {
+			return failed(err)
+		}
+
+		kl.segments = segments
+		for _, entry := range entries[:size] {
+			kl.add(entry)
+		}
+		kl.trim()
+
+		entries = entries[size:]
+	}
+
+	return nil
+}
+
+// segmentFor returns the segment holding offset, or the first one if offset
+// comes before all of them.
+func segmentFor(segments []segmentInfo, offset int) int {
+	n := sort.Search(len(segments), func(i int) bool { return segments[i].Base > offset }) - 1
+	if n < 0 {
+		return 0
+	}
+
+	return n
+}
+
+// readJSON reads a JSON encoded value from lin-kv into v, it returns false
+// if the key doesn't exist yet.
+func (s *server) readJSON(ctx context.Context, key string, v any) (bool, error) {
+	value, err := s.lKv.Read(ctx, key)
+	if err != nil {
+		if maelstrom.ErrorCode(err) == maelstrom.KeyDoesNotExist {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	str, ok := value.(string)
+	if !ok {
+		return false, fmt.Errorf("unexpected value for %s: %v", key, value)
+	}
+
+	return true, json.Unmarshal([]byte(str), v)
+}
+
+// casJSON replaces the JSON encoded value of a key, creating it if it
+// doesn't exist yet.
+func (s *server) casJSON(ctx context.Context, key string, from, to any) error {
+	fromValue, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+
+	toValue, err := json.Marshal(to)
+	if err != nil {
+		return err
+	}
+
+	return s.lKv.CompareAndSwap(ctx, key, string(fromValue), string(toValue), true)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// topicsKey holds the number of partitions of every topic as a JSON object.
+// A topic is split in partitions, each one an ordinary key named
+// <topic>/<partition>, so everything that works on keys also works on
+// partitions and the plain-key protocol keeps working next to topics.
+const topicsKey = "topics"
+
+func partitionKey(topic string, partition int) string {
+	return fmt.Sprintf("%s/%d", topic, partition)
+}
+
+// partitionFor hashes the key of a message to a partition, messages with the
+// same key always go to the same partition and keep their order.
+func partitionFor(key string, partitions int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return int(h.Sum32() % uint32(partitions))
+}
+
+// checkKey rejects sends to plain keys containing a /, which is reserved for
+// the partitions of topics so a plain key can never write into one.
+func checkKey(key string) error {
+	if strings.Contains(key, "/") {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest,
+			fmt.Sprintf("key %q can't contain /, send to its topic instead", key))
+	}
+
+	return nil
+}
+
+type createTopicMsg struct {
+	Type       string `json:"type"`
+	Topic      string `json:"topic"`
+	Partitions int    `json:"partitions,omitempty"`
+}
+
+// createTopicHandler adds a topic to the registry in lin-kv, with one
+// partition unless told otherwise. Creating an existing topic again with the
+// same number of partitions is a no-op.
+func (s *server) createTopicHandler(msg maelstrom.Message) error {
+	var body createTopicMsg
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	if body.Partitions == 0 {
+		body.Partitions = 1
+	}
+
+	if body.Topic == "" || body.Partitions < 0 {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest,
+			fmt.Sprintf("invalid topic %q with %d partitions", body.Topic, body.Partitions))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := s.createTopic(ctx, body.Topic, body.Partitions); err != nil {
+		return err
+	}
+
+	return s.n.Reply(msg, map[string]any{
+		"type": "create_topic_ok",
+	})
+}
+
+func (s *server) createTopic(ctx context.Context, topic string, partitions int) error {
+	for {
+		topics := make(map[string]int)
+		if _, err := s.readJSON(ctx, topicsKey, &topics); err != nil {
+			return err
+		}
+
+		if existing, ok := topics[topic]; ok {
+			if existing != partitions {
+				return maelstrom.NewRPCError(maelstrom.PreconditionFailed,
+					fmt.Sprintf("topic %s already exists with %d partitions", topic, existing))
+			}
+
+			return nil
+		}
+
+		next := make(map[string]int, len(topics)+1)
+		for t, p := range topics {
+			next[t] = p
+		}
+		next[topic] = partitions
+
+		err := s.casJSON(ctx, topicsKey, topics, next)
+		if err == nil {
+			return nil
+		}
+
+		if maelstrom.ErrorCode(err) != maelstrom.PreconditionFailed {
+			return err
+		}
+	}
+}
+
+// topicPartitions returns the number of partitions of a topic, they never
+// change once the topic is created so they are cached.
+func (s *server) topicPartitions(ctx context.Context, topic string) (int, error) {
+	s.mu.RLock()
+	partitions, ok := s.topics[topic]
+	s.mu.RUnlock()
+
+	if ok {
+		return partitions, nil
+	}
+
+	topics := make(map[string]int)
+	if _, err := s.readJSON(ctx, topicsKey, &topics); err != nil {
+		return 0, err
+	}
+
+	partitions, ok = topics[topic]
+	if !ok {
+		return 0, maelstrom.NewRPCError(maelstrom.KeyDoesNotExist,
+			fmt.Sprintf("topic %s does not exist", topic))
+	}
+
+	s.mu.Lock()
+	s.topics[topic] = partitions
+	s.mu.Unlock()
+
+	return partitions, nil
+}
+
+// subscribe adds the partitions of every topic to the offsets of a poll,
+// starting from the beginning unless the offsets already have them.
+func (s *server) subscribe(offsets map[string]int, topics []string) (map[string]int, error) {
+	if len(topics) == 0 {
+		return offsets, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	subscribed := make(map[string]int, len(offsets))
+	for key, offset := range offsets {
+		subscribed[key] = offset
+	}
+
+	for _, topic := range topics {
+		partitions, err := s.topicPartitions(ctx, topic)
+		if err != nil {
+			return nil, err
+		}
+
+		for p := 0; p < partitions; p++ {
+			if _, ok := subscribed[partitionKey(topic, p)]; !ok {
+				subscribed[partitionKey(topic, p)] = 0
+			}
+		}
+	}
+
+	return subscribed, nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// txnTimeout is how long a transaction can stay pending, a poll finding the
+// entries of an older pending transaction aborts it so a node that crashed
+// in the middle of a send_batch doesn't hold back its keys forever.
+// The deadline comes from the clock of the node that began the transaction
+// and is checked against the clock of the polling node, so skew between
+// their clocks shortens or stretches it by as much.
+const txnTimeout = 5 * time.Second
+
+// The status of a transaction is stored in lin-kv under txn/<id>, pending
+// transactions also store their deadline as "pending:<unix ms>".
+const (
+	txnPending   = "pending"
+	txnCommitted = "committed"
+	txnAborted   = "aborted"
+)
+
+func txnKey(id string) string {
+	return "txn/" + id
+}
+
+type batchEntry struct {
+	Key string
+	Msg json.RawMessage
+}
+
+// UnmarshalJSON reads a batch entry from a [key, msg] pair.
+func (e *batchEntry) UnmarshalJSON(data []byte) error {
+	var pair []json.RawMessage
+	if err := json.Unmarshal(data, &pair); err != nil {
+		return err
+	}
+
+	if len(pair) != 2 {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest,
+			fmt.Sprintf("expected a [key, msg] pair, got %s", data))
+	}
+
+	if err := json.Unmarshal(pair[0], &e.Key); err != nil {
+		return err
+	}
+
+	msg, err := compactMsg(pair[1])
+	if err != nil {
+		return err
+	}
+
+	e.Msg = msg
+
+	return nil
+}
+
+// sendBatchMsg can also commit the offsets of a consumer group in the
+// transaction, so a consumer that sends what it read to other keys commits
+// both at once.
+type sendBatchMsg struct {
+	Type          string         `json:"type"`
+	Msgs          []batchEntry   `json:"msgs"`
+	Group         string         `json:"group,omitempty"`
+	CommitOffsets map[string]int `json:"commit_offsets,omitempty"`
+}
+
+// sendBatchHandler appends a list of [key, msg] pairs in a transaction: the
+// entries are appended to their keys marked with the transaction, which is
+// then committed if all of them succeeded and aborted otherwise. Polls skip
+// the entries of aborted transactions and stop at pending ones, so the
+// batch becomes visible all at once or not at all. The entries of an aborted
+// transaction keep their offsets, so consumers see gaps where they were.
+// Offsets committed in the transaction only take effect if it commits too.
+func (s *server) sendBatchHandler(msg maelstrom.Message) error {
+	var body sendBatchMsg
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	for _, entry := range body.Msgs {
+		if err := checkKey(entry.Key); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	txn, pending, err := s.beginTxn(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = s.commitTxnOffsets(txn, body.Group, body.CommitOffsets)
+
+	var offsets []int
+	if err == nil {
+		offsets, err = s.sendTxn(txn, body.Msgs)
+	}
+
+	if err != nil {
+		// A poll may have aborted it already.
+		abortErr := s.finishTxn(txn, pending, txnAborted)
+		if abortErr != nil && maelstrom.ErrorCode(abortErr) != maelstrom.PreconditionFailed {
+			return abortErr
+		}
+
+		return err
+	}
+
+	if err := s.finishTxn(txn, pending, txnCommitted); err != nil {
+		if maelstrom.ErrorCode(err) == maelstrom.PreconditionFailed {
+			return maelstrom.NewRPCError(maelstrom.TxnConflict,
+				fmt.Sprintf("transaction %s timed out and was aborted", txn))
+		}
+
+		return err
+	}
+
+	return s.n.Reply(msg, map[string]any{
+		"type":    "send_batch_ok",
+		"offsets": offsets,
+	})
+}
+
+// beginTxn creates a pending transaction with a new ID made unique by the
+// node ID and the time it started.
+func (s *server) beginTxn(ctx context.Context) (string, string, error) {
+	s.mu.Lock()
+	s.txnSeq++
+	txn := fmt.Sprintf("%s-%d-%d", s.n.ID(), time.Now().UnixNano(), s.txnSeq)
+	s.mu.Unlock()
+
+	pending := fmt.Sprintf("%s:%d", txnPending, time.Now().Add(txnTimeout).UnixMilli())
+
+	return txn, pending, s.lKv.Write(ctx, txnKey(txn), pending)
+}
+
+// sendTxn sends the entries of a transaction, concurrently across keys and
+// in a single append per key, and returns their offsets in the same order.
+func (s *server) sendTxn(txn string, entries []batchEntry) ([]int, error) {
+	byKey := make(map[string][]int)
+	for i, entry := range entries {
+		byKey[entry.Key] = append(byKey[entry.Key], i)
+	}
+
+	offsets := make([]int, len(entries))
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+
+	for key, indexes := range byKey {
+		msgs := make([]json.RawMessage, len(indexes))
+		for j, i := range indexes {
+			msgs[j] = entries[i].Msg
+		}
+
+		wg.Add(1)
+		go func(key string, indexes []int, msgs []json.RawMessage) {
+			defer wg.Done()
+
+			keyOffsets, err := s.send(sendMsg{
+				Type: "send",
+				Key:  key,
+				Msgs: msgs,
+				Txn:  txn,
+			})
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				return
+			}
+
+			for j, i := range indexes {
+				offsets[i] = keyOffsets[j]
+			}
+		}(key, indexes, msgs)
+	}
+
+	wg.Wait()
+
+	return offsets, firstErr
+}
+
+// commitTxnOffsets commits the offsets of a group in a pending transaction
+// by storing a marker of the transaction in their registers. It fails with
+// PreconditionFailed if an offset is already committed, which means the
+// input was already consumed, e.g. by a retry of the same batch whose reply
+// was lost, so the transaction aborts instead of sending its output twice.
+// It fails with TxnConflict if another pending transaction commits one of
+// them. The markers can take as long as the transaction can stay pending.
+func (s *server) commitTxnOffsets(txn, group string, offsets map[string]int) error {
+	if len(offsets) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), txnTimeout)
+	defer cancel()
+
+	generation, err := s.groupGeneration(ctx, group, true)
+	if err != nil {
+		return err
+	}
+
+	for key, offset := range offsets {
+		ckey := committedKey(key, group, generation)
+
+		for {
+			current, err := s.readCommitted(ctx, ckey)
+			if err != nil {
+				return err
+			}
+
+			if current.pending != "" {
+				return maelstrom.NewRPCError(maelstrom.TxnConflict,
+					fmt.Sprintf("%s is being committed by transaction %s", ckey, current.pending))
+			}
+
+			if current.exists && current.offset >= offset {
+				return maelstrom.NewRPCError(maelstrom.PreconditionFailed,
+					fmt.Sprintf("offset %d of %s is already committed for group %q", current.offset, key, group))
+			}
+
+			err = s.lKv.CompareAndSwap(ctx, ckey, current.value, txnMarker(txn, offset, current), true)
+			if err == nil {
+				break
+			}
+
+			if maelstrom.ErrorCode(err) != maelstrom.PreconditionFailed {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// finishTxn moves a pending transaction to its final status, it fails with
+// PreconditionFailed if a poll aborted it first.
+func (s *server) finishTxn(txn, pending, status string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := s.lKv.CompareAndSwap(ctx, txnKey(txn), pending, status, false); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.txns[txn] = status
+	s.mu.Unlock()
+
+	return nil
+}
+
+// txnStatus returns whether a transaction is pending, committed or aborted,
+// aborting it if it's still pending past its deadline. Final statuses never
+// change so they are cached.
+func (s *server) txnStatus(ctx context.Context, txn string) (string, error) {
+	s.mu.RLock()
+	status, ok := s.txns[txn]
+	s.mu.RUnlock()
+
+	if ok {
+		return status, nil
+	}
+
+	for {
+		value, err := s.lKv.Read(ctx, txnKey(txn))
+		if err != nil {
+			return "", err
+		}
+
+		status, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("unexpected status for transaction %s: %v", txn, value)
+		}
+
+		if !strings.HasPrefix(status, txnPending) {
+			s.mu.Lock()
+			s.txns[txn] = status
+			s.mu.Unlock()
+
+			return status, nil
+		}
+
+		deadline, err := strconv.ParseInt(strings.TrimPrefix(status, txnPending+":"), 10, 64)
+		if err != nil {
+			return "", err
+		}
+
+		if time.Now().UnixMilli() < deadline {
+			return txnPending, nil
+		}
+
+		err = s.lKv.CompareAndSwap(ctx, txnKey(txn), status, txnAborted, false)
+		if err != nil && maelstrom.ErrorCode(err) != maelstrom.PreconditionFailed {
+			return "", err
+		}
+	}
+}